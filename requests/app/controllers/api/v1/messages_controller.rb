@@ -34,7 +34,7 @@ module Api
         validator = validate_params(MessageParamsValidator, :update)
         return unless validator
 
-        message = Message.where(token: validator.token, chat_number: validator.chat_number, number: validator.message_number)
+        message = Message.visible.where(token: validator.token, chat_number: validator.chat_number, number: validator.message_number)
                          .pick(:creator_id)
 
         if message.nil?
@@ -46,6 +46,9 @@ module Api
             token: validator.token,
             chatNumber: validator.chat_number.to_i,
             messageNumber: validator.message_number.to_i,
+            editorId: current_user_id,
+            # Microsecond request time orders updates that are applied out of order
+            version: (Time.now.to_r * 1_000_000).to_i,
             body: validator.body
           }
           RabbitMqService.publish('update_messages', msg_data.to_json)
@@ -62,9 +65,9 @@ module Api
         limit = validator.limit_value
         offset = (page - 1) * limit
 
-        messages = Message.where(token: validator.token, chat_number: validator.chat_number)
+        messages = Message.visible.where(token: validator.token, chat_number: validator.chat_number)
                           .joins(:creator)
-                          .select('messages.number, messages.body, messages.created_at, users.name as sender_name')
+                          .select('messages.number, messages.body, messages.edit_count, messages.created_at, users.name as sender_name')
                           .order(id: :desc)
                           .limit(limit)
                           .offset(offset)
@@ -74,11 +77,36 @@ module Api
             messageNumber: msg.number,
             senderName: msg.sender_name,
             body: msg.body,
+            editCount: msg.edit_count,
             createdAt: msg.created_at
           }
         }, status: :ok
       end
 
+      # GET /api/v1/applications/:token/chats/:chat_number/messages/:message_number/revisions
+      def revisions
+        validator = validate_params(MessageParamsValidator, :revisions)
+        return unless validator
+
+        unless Message.visible.exists?(token: validator.token, chat_number: validator.chat_number, number: validator.message_number)
+          return render json: { error: 'Message not found' }, status: :not_found
+        end
+
+        revisions = MessageRevision.for_message(validator.token, validator.chat_number, validator.message_number)
+                                   .left_joins(:editor)
+                                   .select('message_revisions.revision, message_revisions.body, message_revisions.created_at, users.name as editor_name')
+                                   .order(:revision)
+
+        render json: revisions.map { |rev|
+          {
+            revision: rev.revision,
+            body: rev.body,
+            editorName: rev.editor_name,
+            editedAt: rev.created_at
+          }
+        }, status: :ok
+      end
+
       # GET /api/v1/applications/:token/chats/:chat_number/messages/search
       def search
         validator = validate_params(MessageParamsValidator, :search)
@@ -96,6 +124,7 @@ module Api
             messageNumber: msg.number,
             senderName: msg.sender_name,
             body: msg.body,
+            editCount: msg.edit_count,
             createdAt: msg.created_at
           }
         }, status: :ok
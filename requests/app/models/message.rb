@@ -1,6 +1,9 @@
 class Message < ApplicationRecord
   belongs_to :creator, class_name: 'User'
 
+  # Soft-deleted messages are tombstones written by the writer service
+  scope :visible, -> { where(deleted_at: nil) }
+
   validates :number, presence: true, uniqueness: { scope: [:token, :chat_number] }
   validates :body, presence: true
   validates :token, presence: true
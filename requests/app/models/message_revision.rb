@@ -0,0 +1,10 @@
+class MessageRevision < ApplicationRecord
+  belongs_to :editor, class_name: 'User', optional: true
+
+  scope :for_message, ->(token, chat_number, number) {
+    where(token: token, chat_number: chat_number, message_number: number)
+  }
+
+  validates :revision, presence: true, uniqueness: { scope: [:token, :chat_number, :message_number] }
+  validates :body, presence: true
+end
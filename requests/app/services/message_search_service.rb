@@ -86,7 +86,7 @@ class MessageSearchService
         ],
         from: offset,
         size: limit,
-        _source: ['number', 'body', 'created_at', 'sender_name']
+        _source: ['number', 'body', 'edit_count', 'created_at', 'sender_name']
       }
     )
 
@@ -96,6 +96,7 @@ class MessageSearchService
       OpenStruct.new(
         number: source['number'],
         body: source['body'],
+        edit_count: source['edit_count'] || 0,
         created_at: source['created_at'],
         sender_name: source['sender_name']
       )
@@ -108,10 +109,10 @@ class MessageSearchService
   def self.search_with_sql(token, chat_number, query, page, limit)
     offset = (page - 1) * limit
 
-    Message.where(token: token, chat_number: chat_number)
+    Message.visible.where(token: token, chat_number: chat_number)
            .where('messages.body LIKE ?', "%#{query}%")
            .joins(:creator)
-           .select('messages.number, messages.body, messages.created_at, users.name as sender_name')
+           .select('messages.number, messages.body, messages.edit_count, messages.created_at, users.name as sender_name')
            .order(id: :desc)
            .limit(limit)
            .offset(offset)
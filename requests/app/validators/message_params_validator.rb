@@ -6,7 +6,7 @@ class MessageParamsValidator
   validates :body, presence: true, length: { minimum: 1, maximum: 10000 }, on: [:create, :update]
   validates :token, presence: true, format: { with: /\A[a-zA-Z0-9_-]+\z/ }
   validates :chat_number, presence: true, numericality: { only_integer: true, greater_than: 0 }
-  validates :message_number, presence: true, numericality: { only_integer: true, greater_than: 0 }, on: :update
+  validates :message_number, presence: true, numericality: { only_integer: true, greater_than: 0 }, on: [:update, :revisions]
   validates :query, length: { maximum: 1000 }, allow_blank: true, on: :search
   validates :page, numericality: { only_integer: true, greater_than: 0 }, allow_nil: true, on: [:index, :search]
   validates :limit, numericality: { only_integer: true, greater_than: 0, less_than_or_equal_to: 100 }, allow_nil: true, on: [:index, :search]
@@ -28,6 +28,7 @@ Rails.application.routes.draw do
       put 'applications/:token/chats/:chat_number/messages', to: 'messages#update'
       get 'applications/:token/chats/:chat_number/messages', to: 'messages#index'
       get 'applications/:token/chats/:chat_number/messages/search', to: 'messages#search'
+      get 'applications/:token/chats/:chat_number/messages/:message_number/revisions', to: 'messages#revisions'
     end
   end
 
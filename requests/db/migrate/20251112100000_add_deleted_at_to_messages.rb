@@ -0,0 +1,6 @@
+class AddDeletedAtToMessages < ActiveRecord::Migration[7.1]
+  def change
+    # Soft-deleted messages keep their row (and number) as a tombstone
+    add_column :messages, :deleted_at, :datetime
+  end
+end
@@ -0,0 +1,19 @@
+class CreateMessageRevisions < ActiveRecord::Migration[7.1]
+  def change
+    # Previous bodies of edited messages, appended by the writer service
+    create_table :message_revisions do |t|
+      t.string :token, null: false
+      t.integer :chat_number, null: false
+      t.integer :message_number, null: false
+      t.integer :revision, null: false
+      t.text :body, null: false
+      t.bigint :editor_id
+      t.datetime :created_at, null: false
+    end
+
+    add_index :message_revisions, [:token, :chat_number, :message_number, :revision],
+              unique: true, name: 'index_message_revisions_on_message_and_revision'
+
+    add_column :messages, :edit_count, :integer, null: false, default: 0
+  end
+end
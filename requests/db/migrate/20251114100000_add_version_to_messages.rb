@@ -0,0 +1,6 @@
+class AddVersionToMessages < ActiveRecord::Migration[7.1]
+  def change
+    # Version of the last applied update; the writer drops older updates
+    add_column :messages, :version, :bigint, null: false, default: 0
+  end
+end
@@ -0,0 +1,10 @@
+class CreateCronFences < ActiveRecord::Migration[7.1]
+  def change
+    # Newest fencing token that wrote under each writer lease; the writer
+    # rejects writes carrying an older one
+    create_table :cron_fences, id: false do |t|
+      t.string :name, null: false, primary_key: true
+      t.bigint :token, null: false, default: 0
+    end
+  end
+end
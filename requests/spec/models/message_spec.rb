@@ -10,4 +10,10 @@ RSpec.describe Message, type: :model do
     it { should validate_presence_of(:number) }
     it { should validate_presence_of(:body) }
   end
+
+  describe 'scopes' do
+    it '.visible excludes soft-deleted messages' do
+      expect(Message.visible.where_values_hash).to include('deleted_at' => nil)
+    end
+  end
 end
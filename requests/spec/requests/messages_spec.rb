@@ -59,4 +59,27 @@ RSpec.describe 'Api::V1::Messages', type: :request do
       expect(json.size).to eq(1)
     end
   end
+
+  describe 'GET /api/v1/applications/:token/chats/:chat_number/messages/:message_number/revisions' do
+    it 'returns previous bodies oldest first' do
+      message = create(:message, chat: chat, creator: user, body: 'Third')
+      MessageRevision.create!(token: message.token, chat_number: message.chat_number, message_number: message.number,
+                              revision: 2, body: 'Second', editor_id: user.id, created_at: Time.current)
+      MessageRevision.create!(token: message.token, chat_number: message.chat_number, message_number: message.number,
+                              revision: 1, body: 'First', editor_id: user.id, created_at: Time.current)
+
+      get "/api/v1/applications/#{message.token}/chats/#{message.chat_number}/messages/#{message.number}/revisions"
+
+      expect(response).to have_http_status(:ok)
+      json = JSON.parse(response.body)
+      expect(json.map { |rev| rev['body'] }).to eq(%w[First Second])
+      expect(json.first['editorName']).to eq(user.name)
+    end
+
+    it 'returns not found for unknown messages' do
+      get "/api/v1/applications/#{application.token}/chats/#{chat.number}/messages/999/revisions"
+
+      expect(response).to have_http_status(:not_found)
+    end
+  end
 end
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/dlq"
+	"github.com/chat/writer/internal/queue"
+)
+
+const dlqUsage = `Usage:
+  writer dlq list
+  writer dlq peek    <queue> [flags]
+  writer dlq replay  <queue> [flags] [-confirm]
+  writer dlq purge   <queue> [flags] [-confirm]
+
+<queue> is the original queue, e.g. create_chats (a trailing .dlq is ignored).
+replay and purge are dry runs unless -confirm is given.
+
+Flags:
+`
+
+// matchFlags collects repeated -match field=value flags.
+type matchFlags struct {
+	filter *dlq.Filter
+}
+
+func (m matchFlags) String() string {
+	return ""
+}
+
+func (m matchFlags) Set(expr string) error {
+	return m.filter.ParseField(expr)
+}
+
+// runDLQ implements the dlq subcommand and returns the exit code. Its output
+// goes to stdout; only warnings and errors are logged, to stderr.
+func runDLQ(cfg *config.Config, args []string) int {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	var filter dlq.Filter
+	fs := flag.NewFlagSet("dlq", flag.ContinueOnError)
+	limit := fs.Int("limit", 0, "stop after this many matching messages (0: all)")
+	fs.IntVar(&filter.MinRetries, "min-retries", 0, "only messages retried at least this many times")
+	fs.Var(matchFlags{&filter}, "match", "only messages whose payload field equals value, as field=value (repeatable)")
+	confirm := fs.Bool("confirm", false, "actually replay or purge instead of a dry run")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), dlqUsage)
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	command, args := args[0], args[1:]
+
+	var action dlq.Action
+	switch command {
+	case "list":
+	case "peek":
+		action = dlq.Peek
+	case "replay":
+		action = dlq.Replay
+	case "purge":
+		action = dlq.Purge
+	default:
+		fmt.Fprintf(os.Stderr, "unknown dlq command %q\n\n", command)
+		fs.Usage()
+		return 2
+	}
+
+	// The queue may come before or after the flags
+	var queueName string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		queueName, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if queueName == "" {
+		queueName = fs.Arg(0)
+	}
+	queueName = strings.TrimSuffix(queueName, dlq.Suffix)
+	if command != "list" && queueName == "" {
+		fmt.Fprintf(os.Stderr, "dlq %s: missing queue\n\n", command)
+		fs.Usage()
+		return 2
+	}
+
+	rabbit, err := queue.Connect(cfg.RabbitMQURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to RabbitMQ: %v\n", err)
+		return 1
+	}
+	defer rabbit.Close()
+	inspector := dlq.NewInspector(rabbit)
+
+	if command == "list" {
+		stats, err := inspector.List(config.QueueNames())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list DLQs: %v\n", err)
+			return 1
+		}
+		for _, s := range stats {
+			fmt.Printf("%-28s %d\n", s.Queue+dlq.Suffix, s.Messages)
+		}
+		return 0
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	opts := dlq.Options{
+		Queue:  queueName,
+		Filter: filter,
+		Limit:  *limit,
+		Action: action,
+		DryRun: action != dlq.Peek && !*confirm,
+	}
+	result, err := inspector.Run(ctx, opts, func(m dlq.Message) {
+		printMessage(os.Stdout, m)
+	})
+	printResult(os.Stdout, command, opts, result)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dlq %s failed: %v\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+func printMessage(w io.Writer, m dlq.Message) {
+	fmt.Fprintf(w, "#%d retries=%d", m.Index, m.RetryCount)
+	if !m.FirstFailure.IsZero() {
+		fmt.Fprintf(w, " first_failure=%s (%s ago)",
+			m.FirstFailure.UTC().Format(time.RFC3339), time.Since(m.FirstFailure).Round(time.Second))
+	}
+	if m.Reason != "" {
+		fmt.Fprintf(w, " reason=%s", m.Reason)
+	}
+	fmt.Fprintln(w)
+
+	keys := make([]string, 0, len(m.Headers))
+	for key := range m.Headers {
+		if key != "x-death" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s: %v\n", key, m.Headers[key])
+	}
+
+	if m.Payload != nil {
+		body, _ := json.MarshalIndent(m.Payload, "  ", "  ")
+		fmt.Fprintf(w, "  %s\n\n", body)
+	} else {
+		fmt.Fprintf(w, "  %q\n\n", m.Body)
+	}
+}
+
+func printResult(w io.Writer, command string, opts dlq.Options, result dlq.Result) {
+	fmt.Fprintf(w, "Scanned %d message(s) in %s, %d matched", result.Scanned, opts.Queue+dlq.Suffix, result.Matched)
+	switch {
+	case opts.DryRun:
+		fmt.Fprintf(w, "; dry run, rerun with -confirm to %s them\n", command)
+	case opts.Action == dlq.Replay:
+		fmt.Fprintf(w, ", %d replayed to %s\n", result.Replayed, opts.Queue)
+	case opts.Action == dlq.Purge:
+		fmt.Fprintf(w, ", %d purged\n", result.Purged)
+	default:
+		fmt.Fprintln(w)
+	}
+}
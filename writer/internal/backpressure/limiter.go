@@ -0,0 +1,176 @@
+package backpressure
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/metrics"
+)
+
+// defaultMaxInFlight is used when neither the config nor the pool sets a
+// maximum; it matches the pool size database.Connect configures.
+const defaultMaxInFlight = 50
+
+// Limiter bounds how many deliveries are handled at once across consumers.
+// Run adapts the bound to the MySQL connection pool: it is halved whenever
+// queries had to wait for a connection and raised by one again while they
+// didn't. A nil Limiter lets every call through.
+type Limiter struct {
+	cfg   config.BackpressureConfig
+	stats func() sql.DBStats
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	// changed is closed and replaced whenever a slot may have become free
+	changed chan struct{}
+
+	lastWaitCount    int64
+	lastWaitDuration time.Duration
+}
+
+// New returns a Limiter starting at cfg.MaxInFlight, or the pool's maximum
+// open connections when that is 0. stats is usually (*sql.DB).Stats.
+func New(cfg config.BackpressureConfig, stats func() sql.DBStats) *Limiter {
+	s := stats()
+	if cfg.MaxInFlight < 1 {
+		cfg.MaxInFlight = s.MaxOpenConnections
+	}
+	if cfg.MaxInFlight < 1 {
+		cfg.MaxInFlight = defaultMaxInFlight
+	}
+	if cfg.MinInFlight < 1 {
+		cfg.MinInFlight = 1
+	}
+	if cfg.MinInFlight > cfg.MaxInFlight {
+		cfg.MinInFlight = cfg.MaxInFlight
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	metrics.ConcurrencyLimit.Set(float64(cfg.MaxInFlight))
+	return &Limiter{
+		cfg:              cfg,
+		stats:            stats,
+		limit:            cfg.MaxInFlight,
+		changed:          make(chan struct{}),
+		lastWaitCount:    s.WaitCount,
+		lastWaitDuration: s.WaitDuration,
+	}
+}
+
+// Limit returns the current bound.
+func (l *Limiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Acquire blocks until fewer than Limit deliveries are in flight or ctx is
+// done. Every successful Acquire must be paired with a Release.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		if l.inFlight < l.limit {
+			l.inFlight++
+			metrics.InFlight.Set(float64(l.inFlight))
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release frees the slot taken by Acquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	metrics.InFlight.Set(float64(l.inFlight))
+	l.notify()
+}
+
+// Run samples the pool stats every Interval and adjusts the bound until ctx
+// is cancelled.
+func (l *Limiter) Run(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	ticker := time.NewTicker(l.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.adjust()
+		}
+	}
+}
+
+// adjust halves the bound if more than WaitThreshold queries waited for a
+// connection since the last sample, and raises it by one otherwise. Slots
+// already taken are kept; a lower bound only holds back new deliveries.
+func (l *Limiter) adjust() {
+	s := l.stats()
+	waits := s.WaitCount - l.lastWaitCount
+	waited := s.WaitDuration - l.lastWaitDuration
+	l.lastWaitCount = s.WaitCount
+	l.lastWaitDuration = s.WaitDuration
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if waits > int64(l.cfg.WaitThreshold) {
+		limit := max(l.limit/2, l.cfg.MinInFlight)
+		if limit == l.limit {
+			return
+		}
+		slog.Warn("Lowering concurrency limit, MySQL connections are contended",
+			"limit", limit, "previous_limit", l.limit, "waits", waits, "waited", waited,
+			"in_use", s.InUse, "max_open", s.MaxOpenConnections)
+		l.setLimit(limit)
+		return
+	}
+
+	if l.limit < l.cfg.MaxInFlight {
+		l.setLimit(l.limit + 1)
+		if l.limit == l.cfg.MaxInFlight {
+			slog.Info("Concurrency limit restored", "limit", l.limit)
+		}
+		l.notify()
+	}
+}
+
+// setLimit must be called with l.mu held.
+func (l *Limiter) setLimit(limit int) {
+	l.limit = limit
+	metrics.ConcurrencyLimit.Set(float64(limit))
+}
+
+// notify wakes every blocked Acquire. It must be called with l.mu held.
+func (l *Limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
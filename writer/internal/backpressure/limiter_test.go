@@ -0,0 +1,173 @@
+package backpressure
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chat/writer/internal/config"
+)
+
+// fakePool hands out stats whose wait count tests raise by hand.
+type fakePool struct {
+	mu    sync.Mutex
+	stats sql.DBStats
+}
+
+func (p *fakePool) Stats() sql.DBStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+func (p *fakePool) wait(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.WaitCount += n
+	p.stats.WaitDuration += time.Duration(n) * time.Millisecond
+}
+
+func TestNew_DefaultsToPoolSize(t *testing.T) {
+	pool := &fakePool{stats: sql.DBStats{MaxOpenConnections: 50}}
+	l := New(config.BackpressureConfig{}, pool.Stats)
+	if l.Limit() != 50 {
+		t.Errorf("expected limit 50, got %d", l.Limit())
+	}
+
+	l = New(config.BackpressureConfig{MaxInFlight: 8}, pool.Stats)
+	if l.Limit() != 8 {
+		t.Errorf("expected limit 8, got %d", l.Limit())
+	}
+}
+
+func TestAdjust_HalvesOnWaitsAndRecoversGradually(t *testing.T) {
+	pool := &fakePool{stats: sql.DBStats{MaxOpenConnections: 50, WaitCount: 100}}
+	l := New(config.BackpressureConfig{MaxInFlight: 16, MinInFlight: 3}, pool.Stats)
+
+	// Waits counted before New don't lower the limit
+	l.adjust()
+	if l.Limit() != 16 {
+		t.Fatalf("expected limit 16, got %d", l.Limit())
+	}
+
+	for _, want := range []int{8, 4, 3, 3} {
+		pool.wait(5)
+		l.adjust()
+		if l.Limit() != want {
+			t.Fatalf("expected limit %d after waits, got %d", want, l.Limit())
+		}
+	}
+
+	for _, want := range []int{4, 5, 6} {
+		l.adjust()
+		if l.Limit() != want {
+			t.Fatalf("expected limit %d without waits, got %d", want, l.Limit())
+		}
+	}
+}
+
+func TestAdjust_IgnoresWaitsUpToThreshold(t *testing.T) {
+	pool := &fakePool{}
+	l := New(config.BackpressureConfig{MaxInFlight: 10, WaitThreshold: 2}, pool.Stats)
+
+	pool.wait(2)
+	l.adjust()
+	if l.Limit() != 10 {
+		t.Errorf("expected limit 10, got %d", l.Limit())
+	}
+
+	pool.wait(3)
+	l.adjust()
+	if l.Limit() != 5 {
+		t.Errorf("expected limit 5, got %d", l.Limit())
+	}
+}
+
+func TestAcquire_BlocksAtLimitUntilRelease(t *testing.T) {
+	pool := &fakePool{}
+	l := New(config.BackpressureConfig{MaxInFlight: 2}, pool.Stats)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire(ctx); err != nil {
+			t.Fatalf("expected a free slot, got %v", err)
+		}
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- l.Acquire(ctx)
+	}()
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("expected Acquire to block at the limit, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.Release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("expected the released slot, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Acquire to return after Release")
+	}
+}
+
+func TestAcquire_LowerLimitHoldsBackNewCallers(t *testing.T) {
+	pool := &fakePool{}
+	l := New(config.BackpressureConfig{MaxInFlight: 4, MinInFlight: 1}, pool.Stats)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		l.Acquire(ctx)
+	}
+	pool.wait(1)
+	l.adjust()
+
+	// 3 in flight, limit 2: the next caller waits for two releases
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- l.Acquire(ctx)
+	}()
+
+	l.Release()
+	select {
+	case err := <-acquired:
+		t.Fatalf("expected Acquire to block above the lowered limit, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected Acquire to return once below the limit")
+	}
+}
+
+func TestAcquire_StopsWithContext(t *testing.T) {
+	pool := &fakePool{}
+	l := New(config.BackpressureConfig{MaxInFlight: 1}, pool.Stats)
+	l.Acquire(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestLimiter_NilLetsEverythingThrough(t *testing.T) {
+	var l *Limiter
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Errorf("expected nil limiter to allow, got %v", err)
+	}
+	l.Release()
+	l.Run(context.Background())
+}
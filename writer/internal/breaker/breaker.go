@@ -0,0 +1,213 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/metrics"
+)
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+	// Open fails every call with ErrOpen until a probe succeeds.
+	Open
+	// HalfOpen fails every call while a probe is running.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// ErrOpen is returned for calls made while a breaker isn't closed.
+var ErrOpen = errors.New("circuit breaker open")
+
+// Breaker stops calls to a dependency that keeps failing. It opens after
+// FailureThreshold consecutive calls failed with an error isFailure accepts,
+// then runs probe every Cooldown and closes again once probe succeeds. A nil
+// Breaker lets every call through.
+type Breaker struct {
+	name      string
+	cfg       config.BreakerConfig
+	probe     func(ctx context.Context) error
+	isFailure func(err error) bool
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	lastErr  error
+	// recovered is closed when the breaker closes again
+	recovered chan struct{}
+}
+
+func New(name string, cfg config.BreakerConfig, probe func(ctx context.Context) error, isFailure func(err error) bool) *Breaker {
+	if cfg.FailureThreshold < 1 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 5 * time.Second
+	}
+	metrics.CircuitBreakerState.WithLabelValues(name).Set(float64(Closed))
+	return &Breaker{
+		name:      name,
+		cfg:       cfg,
+		probe:     probe,
+		isFailure: isFailure,
+	}
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow returns an error wrapping ErrOpen unless the breaker is closed.
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != Closed {
+		return fmt.Errorf("%s: %w", b.name, ErrOpen)
+	}
+	return nil
+}
+
+// Record counts the outcome of a call. Errors isFailure rejects mean the
+// dependency answered and count as successes.
+func (b *Breaker) Record(err error) {
+	if b == nil || errors.Is(err, ErrOpen) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != Closed {
+		return
+	}
+	if err == nil || !b.isFailure(err) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.lastErr = err
+	if b.failures >= b.cfg.FailureThreshold {
+		b.open()
+	}
+}
+
+// Do runs fn unless the breaker is open and records its outcome.
+func (b *Breaker) Do(fn func() error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.Record(err)
+	return err
+}
+
+// Wait blocks until the breaker is closed or ctx is done.
+func (b *Breaker) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	if b.state == Closed {
+		b.mu.Unlock()
+		return nil
+	}
+	recovered := b.recovered
+	b.mu.Unlock()
+
+	select {
+	case <-recovered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check is a health check failing while the breaker isn't closed.
+func (b *Breaker) Check(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Closed {
+		return nil
+	}
+	return fmt.Errorf("%s since %s: %v", b.state, b.openedAt.UTC().Format(time.RFC3339), b.lastErr)
+}
+
+// open must be called with b.mu held.
+func (b *Breaker) open() {
+	b.setState(Open)
+	b.openedAt = time.Now()
+	b.recovered = make(chan struct{})
+	slog.Warn("Circuit breaker opened", "breaker", b.name,
+		"failures", b.failures, "cooldown", b.cfg.Cooldown, "error", b.lastErr)
+	go b.probeUntilRecovered()
+}
+
+// probeUntilRecovered probes the dependency every Cooldown while the breaker
+// is open and closes it after the first successful probe.
+func (b *Breaker) probeUntilRecovered() {
+	for {
+		time.Sleep(b.cfg.Cooldown)
+
+		b.mu.Lock()
+		b.setState(HalfOpen)
+		b.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.cfg.Cooldown)
+		err := b.probe(ctx)
+		cancel()
+
+		b.mu.Lock()
+		if err == nil {
+			b.setState(Closed)
+			b.failures = 0
+			close(b.recovered)
+			slog.Info("Circuit breaker closed", "breaker", b.name, "open_for", time.Since(b.openedAt))
+			b.mu.Unlock()
+			return
+		}
+		b.setState(Open)
+		b.lastErr = err
+		b.mu.Unlock()
+		slog.Warn("Circuit breaker probe failed", "breaker", b.name, "error", err)
+	}
+}
+
+// setState must be called with b.mu held.
+func (b *Breaker) setState(state State) {
+	b.state = state
+	metrics.CircuitBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
@@ -0,0 +1,111 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chat/writer/internal/config"
+)
+
+var (
+	errDown     = errors.New("connection refused")
+	errRejected = errors.New("data too long")
+)
+
+func isDown(err error) bool {
+	return errors.Is(err, errDown)
+}
+
+func newTestBreaker(probe func(ctx context.Context) error) *Breaker {
+	return New("test", config.BreakerConfig{FailureThreshold: 3, Cooldown: 10 * time.Millisecond}, probe, isDown)
+}
+
+func TestBreaker_OpensAfterConsecutiveFailures(t *testing.T) {
+	b := newTestBreaker(func(ctx context.Context) error { return errDown })
+
+	b.Record(errDown)
+	b.Record(errDown)
+	b.Record(errRejected) // the dependency answered
+	b.Record(errDown)
+	b.Record(errDown)
+	if b.State() != Closed {
+		t.Fatalf("expected failures to reset on an answer, got %s", b.State())
+	}
+
+	b.Record(errDown)
+	if b.State() != Open {
+		t.Fatalf("expected breaker to open after 3 consecutive failures, got %s", b.State())
+	}
+
+	called := false
+	err := b.Do(func() error {
+		called = true
+		return nil
+	})
+	if called || !errors.Is(err, ErrOpen) {
+		t.Errorf("expected Do to fail fast with ErrOpen, got %v (called=%v)", err, called)
+	}
+	if err := b.Check(context.Background()); err == nil {
+		t.Error("expected the health check to fail while open")
+	}
+}
+
+func TestBreaker_ClosesOnceProbeSucceeds(t *testing.T) {
+	var probes atomic.Int32
+	b := newTestBreaker(func(ctx context.Context) error {
+		if probes.Add(1) < 3 {
+			return errDown
+		}
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		b.Record(errDown)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.Wait(ctx); err != nil {
+		t.Fatalf("breaker did not close: %v", err)
+	}
+
+	if b.State() != Closed || probes.Load() != 3 {
+		t.Errorf("expected breaker closed after the third probe, got %s after %d", b.State(), probes.Load())
+	}
+	if err := b.Do(func() error { return nil }); err != nil {
+		t.Errorf("expected calls to go through again, got %v", err)
+	}
+	if err := b.Check(context.Background()); err != nil {
+		t.Errorf("expected the health check to pass, got %v", err)
+	}
+}
+
+func TestBreaker_WaitStopsWithContext(t *testing.T) {
+	b := newTestBreaker(func(ctx context.Context) error { return errDown })
+	for i := 0; i < 3; i++ {
+		b.Record(errDown)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Wait to stop with the context, got %v", err)
+	}
+	if b.State() == Closed {
+		t.Error("expected breaker to stay open while probes fail")
+	}
+}
+
+func TestBreaker_NilLetsEverythingThrough(t *testing.T) {
+	var b *Breaker
+
+	if err := b.Do(func() error { return errDown }); err != errDown {
+		t.Errorf("expected fn's error, got %v", err)
+	}
+	b.Record(errDown)
+	if b.State() != Closed || b.Wait(context.Background()) != nil || b.Check(context.Background()) != nil {
+		t.Error("expected a nil breaker to stay closed")
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoad_ZeroDisablesSettingsThatAllowIt(t *testing.T) {
+	t.Setenv("RETRY_MAX_AGE_MS", "0")
+	t.Setenv("DELETE_MESSAGES_RETRY_MAX_ATTEMPTS", "0")
+	t.Setenv("COUNT_RECONCILE_JITTER_MS", "0")
+	t.Setenv("DB_BACKPRESSURE_WAIT_THRESHOLD", "0")
+	t.Setenv("ES_MAX_RETRIES", "0")
+
+	cfg := Load()
+	if cfg.DefaultQueue.Retry.MaxAge != 0 {
+		t.Errorf("expected max age 0, got %v", cfg.DefaultQueue.Retry.MaxAge)
+	}
+	if cfg.Queue("create_messages").Retry.MaxAge != 0 {
+		t.Errorf("expected per-queue max age to inherit 0, got %v", cfg.Queue("create_messages").Retry.MaxAge)
+	}
+	if cfg.Queue("delete_messages").Retry.MaxAttempts != 0 {
+		t.Errorf("expected max attempts 0, got %d", cfg.Queue("delete_messages").Retry.MaxAttempts)
+	}
+	if cfg.Reconcile.Jitter != 0 {
+		t.Errorf("expected reconcile jitter 0, got %v", cfg.Reconcile.Jitter)
+	}
+	if cfg.Backpressure.WaitThreshold != 0 {
+		t.Errorf("expected wait threshold 0, got %d", cfg.Backpressure.WaitThreshold)
+	}
+	if cfg.Elasticsearch.MaxRetries != 0 {
+		t.Errorf("expected ES max retries 0, got %d", cfg.Elasticsearch.MaxRetries)
+	}
+}
+
+func TestLoad_InvalidValuesFallBackToDefaults(t *testing.T) {
+	t.Setenv("RETRY_MAX_AGE_MS", "-1")
+	t.Setenv("COUNT_RECONCILE_JITTER_MS", "soon")
+	t.Setenv("QUEUE_WORKERS", "0")
+	t.Setenv("CRON_LEASE_TTL_MS", "-5")
+
+	cfg := Load()
+	if cfg.DefaultQueue.Retry.MaxAge != time.Hour {
+		t.Errorf("expected default max age, got %v", cfg.DefaultQueue.Retry.MaxAge)
+	}
+	if cfg.Reconcile.Jitter != time.Minute {
+		t.Errorf("expected default reconcile jitter, got %v", cfg.Reconcile.Jitter)
+	}
+	if cfg.DefaultQueue.Workers != 4 {
+		t.Errorf("expected 0 workers to fall back to 4, got %d", cfg.DefaultQueue.Workers)
+	}
+	if cfg.Cron.LeaseTTL != 15*time.Second {
+		t.Errorf("expected default lease TTL, got %v", cfg.Cron.LeaseTTL)
+	}
+}
@@ -2,19 +2,23 @@ package cron
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/chat/writer/internal/config"
 	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/logging"
+	"github.com/chat/writer/internal/metrics"
 	"github.com/redis/go-redis/v9"
 )
 
 type CountSync struct {
 	db          *database.DB
 	redisClient *database.RedisClient
+	batchSize   int
 }
 
 type CountUpdate struct {
@@ -28,79 +32,108 @@ type messageUpdate struct {
 	count      int
 }
 
-func NewCountSync(db *database.DB, redisClient *database.RedisClient) *CountSync {
+func NewCountSync(db *database.DB, redisClient *database.RedisClient, cfg config.CountSyncConfig) *CountSync {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 100
+	}
 	return &CountSync{
 		db:          db,
 		redisClient: redisClient,
+		batchSize:   cfg.BatchSize,
 	}
 }
 
-func (cs *CountSync) Start(ctx context.Context) {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-
-	log.Println("Starting count sync cron job (every 10 seconds)...")
-
-	// Run immediately on start
-	cs.syncCounts()
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("CountSync: Shutting down gracefully...")
-			// Perform final sync before stopping
-			log.Println("CountSync: Performing final sync...")
-			cs.syncCounts()
-			log.Println("CountSync: Final sync completed")
-			return
-		case <-ticker.C:
-			cs.syncCounts()
-		}
+// Sync copies the Redis counters of every changed application and chat to
+// MySQL. It is run by the scheduler.
+func (cs *CountSync) Sync(ctx context.Context) error {
+	start := time.Now()
+	defer func() {
+		metrics.CountSyncDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	var errs []error
+	if err := cs.syncChatsCount(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to sync chats count: %w", err))
 	}
-}
 
-func (cs *CountSync) syncCounts() {
-	if err := cs.syncChatsCount(); err != nil {
-		log.Printf("Error syncing chats count: %v", err)
+	if err := cs.syncMessagesCount(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to sync messages count: %w", err))
 	}
+	return errors.Join(errs...)
+}
+
+const (
+	chatChangesKey    = "chat_changes"
+	messageChangesKey = "message_changes"
 
-	if err := cs.syncMessagesCount(); err != nil {
-		log.Printf("Error syncing messages count: %v", err)
+	// Members being synced live here until the sync finishes, so a crash
+	// mid-sync doesn't lose them
+	processingSuffix = ":processing"
+)
+
+// drainChanges atomically takes every member of the change set, hands them to
+// sync and puts back the ones sync reports as failed. Members added while
+// sync runs stay in the change set for the next run.
+func (cs *CountSync) drainChanges(ctx context.Context, key string, sync func(ctx context.Context, members []string) []string) error {
+	if err := VerifyLease(ctx); err != nil {
+		return err
 	}
-}
 
-func (cs *CountSync) syncChatsCount() error {
-	// Get all changed tokens from Redis set
-	tokens, err := cs.redisClient.SMembers("chat_changes")
+	processingKey := key + processingSuffix
+	redisClient := cs.redisClient.WithContext(ctx)
+
+	members, err := redisClient.DrainSet(key, processingKey)
 	if err != nil {
-		return fmt.Errorf("failed to get chat_changes set: %w", err)
+		return fmt.Errorf("failed to drain %s set: %w", key, err)
 	}
 
-	if len(tokens) == 0 {
+	if len(members) == 0 {
 		return nil
 	}
 
-	// Clear the set immediately to avoid reprocessing
-	if err := cs.redisClient.Del("chat_changes"); err != nil {
-		log.Printf("Warning: Failed to clear chat_changes set: %v", err)
+	failed := sync(ctx, members)
+	metrics.CountSyncKeysTotal.WithLabelValues(key, "synced").Add(float64(len(members) - len(failed)))
+	metrics.CountSyncKeysTotal.WithLabelValues(key, "failed").Add(float64(len(failed)))
+
+	if err := redisClient.FinishDrain(key, processingKey, failed...); err != nil {
+		// The members are still in the processing set and are picked up by the next drain
+		return fmt.Errorf("failed to finish draining %s set: %w", key, err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d %s members failed to sync and were re-added", len(failed), len(members), key)
 	}
 
-	batchSize := 100
+	return nil
+}
+
+func (cs *CountSync) syncChatsCount(ctx context.Context) error {
+	return cs.drainChanges(ctx, chatChangesKey, cs.syncChatTokens)
+}
+
+// syncChatTokens copies chat_counter values of tokens to the database and
+// returns the tokens that could not be synced.
+func (cs *CountSync) syncChatTokens(ctx context.Context, tokens []string) []string {
+	logger := logging.FromContext(ctx)
+	redisClient := cs.redisClient.WithContext(ctx)
+	batchSize := cs.batchSize
 	totalSynced := 0
+	var failed []string
 
 	// Process tokens in batches
 	for i := 0; i < len(tokens); i += batchSize {
-		end := min(i + batchSize, len(tokens))
+		end := min(i+batchSize, len(tokens))
 		batchTokens := tokens[i:end]
 
 		var updates []CountUpdate
 		for _, token := range batchTokens {
 			// Get count from Redis counter
 			redisKey := fmt.Sprintf("chat_counter:%s", token)
-			count, err := cs.redisClient.GetInt(redisKey)
+			count, err := redisClient.GetInt(redisKey)
 			if err != nil {
+				// A missing counter has nothing to sync (e.g. the application was deleted)
 				if err != redis.Nil {
-					log.Printf("Error getting Redis key %s: %v", redisKey, err)
+					logger.Error("Error getting Redis key", "key", redisKey, "error", err)
+					failed = append(failed, token)
 				}
 				continue
 			}
@@ -113,65 +146,67 @@ func (cs *CountSync) syncChatsCount() error {
 
 		// Update database for this batch
 		if len(updates) > 0 {
-			if err := cs.batchUpdateChatsCount(updates); err != nil {
-				log.Printf("Error in batch update chats count: %v", err)
-				return err
+			err := Fenced(ctx, cs.db, func(exec Execer) error {
+				return cs.batchUpdateChatsCount(ctx, exec, updates)
+			})
+			if err != nil {
+				logger.Error("Error in batch update of chats counts", "batch_size", len(updates), "error", err)
+				for _, update := range updates {
+					failed = append(failed, update.Token)
+				}
+				continue
 			}
 			totalSynced += len(updates)
 		}
 	}
 
 	if totalSynced > 0 {
-		log.Printf("Synced %d chat counts", totalSynced)
+		logger.Info("Synced chat counts", "synced", totalSynced)
 	}
 
-	return nil
+	return failed
 }
 
-func (cs *CountSync) syncMessagesCount() error {
-	// Get all changed token:chatNumber from Redis set
-	chatKeys, err := cs.redisClient.SMembers("message_changes")
-	if err != nil {
-		return fmt.Errorf("failed to get message_changes set: %w", err)
-	}
-
-	if len(chatKeys) == 0 {
-		return nil
-	}
-
-	// Clear the set immediately to avoid reprocessing
-	if err := cs.redisClient.Del("message_changes"); err != nil {
-		log.Printf("Warning: Failed to clear message_changes set: %v", err)
-	}
+func (cs *CountSync) syncMessagesCount(ctx context.Context) error {
+	return cs.drainChanges(ctx, messageChangesKey, cs.syncChatKeys)
+}
 
-	batchSize := 100
+// syncChatKeys copies message_counter values of token:chatNumber keys to the
+// database and returns the keys that could not be synced.
+func (cs *CountSync) syncChatKeys(ctx context.Context, chatKeys []string) []string {
+	logger := logging.FromContext(ctx)
+	redisClient := cs.redisClient.WithContext(ctx)
+	batchSize := cs.batchSize
 	totalSynced := 0
+	var failed []string
 
 	// Process chat keys in batches
 	for i := 0; i < len(chatKeys); i += batchSize {
-		end := min(i + batchSize, len(chatKeys))
+		end := min(i+batchSize, len(chatKeys))
 		batchChatKeys := chatKeys[i:end]
 
 		var updates []messageUpdate
 		for _, key := range batchChatKeys {
 			parts := strings.SplitN(key, ":", 2)
 			if len(parts) != 2 {
-				log.Printf("Invalid chat key format: %s", key)
+				logger.Warn("Invalid chat key format", "key", key)
 				continue
 			}
 			token := parts[0]
 			chatNumber, err := strconv.Atoi(parts[1])
 			if err != nil {
-				log.Printf("Invalid chat number in key %s: %v", key, err)
+				logger.Warn("Invalid chat number in key", "key", key, "error", err)
 				continue
 			}
 
 			// Get count from Redis counter
 			redisKey := fmt.Sprintf("message_counter:%s:%d", token, chatNumber)
-			count, err := cs.redisClient.GetInt(redisKey)
+			count, err := redisClient.GetInt(redisKey)
 			if err != nil {
+				// A missing counter has nothing to sync (e.g. the chat was deleted)
 				if err != redis.Nil {
-					log.Printf("Error getting Redis key %s: %v", redisKey, err)
+					logger.Error("Error getting Redis key", "key", redisKey, "error", err)
+					failed = append(failed, key)
 				}
 				continue
 			}
@@ -185,22 +220,28 @@ func (cs *CountSync) syncMessagesCount() error {
 
 		// Update database for this batch
 		if len(updates) > 0 {
-			if err := cs.batchUpdateMessagesCount(updates); err != nil {
-				log.Printf("Error in batch update messages count: %v", err)
-				return err
+			err := Fenced(ctx, cs.db, func(exec Execer) error {
+				return cs.batchUpdateMessagesCount(ctx, exec, updates)
+			})
+			if err != nil {
+				logger.Error("Error in batch update of messages counts", "batch_size", len(updates), "error", err)
+				for _, update := range updates {
+					failed = append(failed, fmt.Sprintf("%s:%d", update.token, update.chatNumber))
+				}
+				continue
 			}
 			totalSynced += len(updates)
 		}
 	}
 
 	if totalSynced > 0 {
-		log.Printf("Synced %d message counts", totalSynced)
+		logger.Info("Synced message counts", "synced", totalSynced)
 	}
 
-	return nil
+	return failed
 }
 
-func (cs *CountSync) batchUpdateChatsCount(updates []CountUpdate) error {
+func (cs *CountSync) batchUpdateChatsCount(ctx context.Context, exec Execer, updates []CountUpdate) error {
 	if len(updates) == 0 {
 		return nil
 	}
@@ -235,11 +276,11 @@ func (cs *CountSync) batchUpdateChatsCount(updates []CountUpdate) error {
 		WHERE token IN (%s)
 	`, strings.Join(whenClauses, " "), strings.Join(tokenPlaceholders, ", "))
 
-	_, err := cs.db.Exec(query, args...)
+	_, err := exec.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (cs *CountSync) batchUpdateMessagesCount(updates []messageUpdate) error {
+func (cs *CountSync) batchUpdateMessagesCount(ctx context.Context, exec Execer, updates []messageUpdate) error {
 	if len(updates) == 0 {
 		return nil
 	}
@@ -272,6 +313,6 @@ func (cs *CountSync) batchUpdateMessagesCount(updates []messageUpdate) error {
 		WHERE %s
 	`, strings.Join(whenClauses, " "), strings.Join(conditions, " OR "))
 
-	_, err := cs.db.Exec(query, args...)
+	_, err := exec.ExecContext(ctx, query, args...)
 	return err
 }
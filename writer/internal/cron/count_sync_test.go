@@ -1,10 +1,15 @@
 package cron
 
 import (
+	"context"
+	"sort"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chat/writer/internal/config"
 	"github.com/chat/writer/internal/database"
+	"github.com/redis/go-redis/v9"
 )
 
 func TestBatchUpdateChatsCount_PreventsSQLInjection(t *testing.T) {
@@ -18,7 +23,7 @@ func TestBatchUpdateChatsCount_PreventsSQLInjection(t *testing.T) {
 	// Create CountSync with mock DB
 	mockDB := &database.DB{DB: db}
 	redisClient := &database.RedisClient{} // Not used in this test
-	cs := NewCountSync(mockDB, redisClient)
+	cs := NewCountSync(mockDB, redisClient, config.CountSyncConfig{})
 
 	// Test with malicious token containing SQL injection attempt
 	updates := []CountUpdate{
@@ -47,7 +52,7 @@ func TestBatchUpdateChatsCount_PreventsSQLInjection(t *testing.T) {
 		).
 		WillReturnResult(sqlmock.NewResult(0, 3))
 
-	err = cs.batchUpdateChatsCount(updates)
+	err = cs.batchUpdateChatsCount(context.Background(), mockDB, updates)
 	if err != nil {
 		t.Errorf("Expected no error, got: %v", err)
 	}
@@ -68,7 +73,7 @@ func TestBatchUpdateMessagesCount_PreventsSQLInjection(t *testing.T) {
 	// Create CountSync with mock DB
 	mockDB := &database.DB{DB: db}
 	redisClient := &database.RedisClient{} // Not used in this test
-	cs := NewCountSync(mockDB, redisClient)
+	cs := NewCountSync(mockDB, redisClient, config.CountSyncConfig{})
 
 	// Test with malicious token containing SQL injection attempt
 	updates := []messageUpdate{
@@ -99,7 +104,7 @@ func TestBatchUpdateMessagesCount_PreventsSQLInjection(t *testing.T) {
 		).
 		WillReturnResult(sqlmock.NewResult(0, 3))
 
-	err = cs.batchUpdateMessagesCount(updates)
+	err = cs.batchUpdateMessagesCount(context.Background(), mockDB, updates)
 	if err != nil {
 		t.Errorf("Expected no error, got: %v", err)
 	}
@@ -119,12 +124,12 @@ func TestBatchUpdateChatsCount_EmptyUpdates(t *testing.T) {
 
 	mockDB := &database.DB{DB: db}
 	redisClient := &database.RedisClient{}
-	cs := NewCountSync(mockDB, redisClient)
+	cs := NewCountSync(mockDB, redisClient, config.CountSyncConfig{})
 
 	// Empty updates should not execute query
 	updates := []CountUpdate{}
 
-	err = cs.batchUpdateChatsCount(updates)
+	err = cs.batchUpdateChatsCount(context.Background(), mockDB, updates)
 	if err != nil {
 		t.Errorf("Expected no error for empty updates, got: %v", err)
 	}
@@ -140,12 +145,12 @@ func TestBatchUpdateMessagesCount_EmptyUpdates(t *testing.T) {
 
 	mockDB := &database.DB{DB: db}
 	redisClient := &database.RedisClient{}
-	cs := NewCountSync(mockDB, redisClient)
+	cs := NewCountSync(mockDB, redisClient, config.CountSyncConfig{})
 
 	// Empty updates should not execute query
 	updates := []messageUpdate{}
 
-	err = cs.batchUpdateMessagesCount(updates)
+	err = cs.batchUpdateMessagesCount(context.Background(), mockDB, updates)
 	if err != nil {
 		t.Errorf("Expected no error for empty updates, got: %v", err)
 	}
@@ -161,7 +166,7 @@ func TestBatchUpdateChatsCount_SpecialCharacters(t *testing.T) {
 
 	mockDB := &database.DB{DB: db}
 	redisClient := &database.RedisClient{}
-	cs := NewCountSync(mockDB, redisClient)
+	cs := NewCountSync(mockDB, redisClient, config.CountSyncConfig{})
 
 	// Test with various special characters that could cause issues
 	updates := []CountUpdate{
@@ -195,7 +200,7 @@ func TestBatchUpdateChatsCount_SpecialCharacters(t *testing.T) {
 		).
 		WillReturnResult(sqlmock.NewResult(0, 5))
 
-	err = cs.batchUpdateChatsCount(updates)
+	err = cs.batchUpdateChatsCount(context.Background(), mockDB, updates)
 	if err != nil {
 		t.Errorf("Expected no error, got: %v", err)
 	}
@@ -204,3 +209,128 @@ func TestBatchUpdateChatsCount_SpecialCharacters(t *testing.T) {
 		t.Errorf("Unfulfilled expectations: %v", err)
 	}
 }
+
+func newTestCountSync(t *testing.T) (*CountSync, *miniredis.Miniredis, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewCountSync(&database.DB{DB: db}, database.NewRedisClient(client, context.Background()), config.CountSyncConfig{}), mr, mock
+}
+
+func TestDrainChanges_KeepsMembersAddedDuringSync(t *testing.T) {
+	cs, mr, _ := newTestCountSync(t)
+	mr.SAdd(chatChangesKey, "a", "b")
+
+	err := cs.drainChanges(context.Background(), chatChangesKey, func(ctx context.Context, members []string) []string {
+		// Simulates the API recording a change while the sync is running
+		mr.SAdd(chatChangesKey, "c")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	members, _ := mr.Members(chatChangesKey)
+	if len(members) != 1 || members[0] != "c" {
+		t.Errorf("Expected only the new change to remain, got: %v", members)
+	}
+	if mr.Exists(chatChangesKey + processingSuffix) {
+		t.Error("Expected the processing set to be cleared")
+	}
+}
+
+func TestDrainChanges_ReaddsFailedMembers(t *testing.T) {
+	cs, mr, _ := newTestCountSync(t)
+	mr.SAdd(chatChangesKey, "a", "b", "c")
+
+	err := cs.drainChanges(context.Background(), chatChangesKey, func(ctx context.Context, members []string) []string {
+		return []string{"b"}
+	})
+	if err == nil {
+		t.Error("Expected an error reporting the failed member")
+	}
+
+	members, _ := mr.Members(chatChangesKey)
+	if len(members) != 1 || members[0] != "b" {
+		t.Errorf("Expected the failed member to be re-added, got: %v", members)
+	}
+}
+
+func TestDrainChanges_RecoversMembersOfCrashedRun(t *testing.T) {
+	cs, mr, _ := newTestCountSync(t)
+	mr.SAdd(chatChangesKey+processingSuffix, "a")
+	mr.SAdd(chatChangesKey, "b")
+
+	var synced []string
+	err := cs.drainChanges(context.Background(), chatChangesKey, func(ctx context.Context, members []string) []string {
+		synced = members
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	sort.Strings(synced)
+	if len(synced) != 2 || synced[0] != "a" || synced[1] != "b" {
+		t.Errorf("Expected leftover and new members to be synced, got: %v", synced)
+	}
+}
+
+func TestSyncChatTokens_ReturnsBatchOnDatabaseError(t *testing.T) {
+	cs, mr, mock := newTestCountSync(t)
+	mr.Set("chat_counter:a", "3")
+	mr.Set("chat_counter:b", "5")
+
+	mock.ExpectExec(`UPDATE applications`).WillReturnError(sqlmock.ErrCancelled)
+
+	failed := cs.syncChatTokens(context.Background(), []string{"a", "b", "gone"})
+
+	sort.Strings(failed)
+	if len(failed) != 2 || failed[0] != "a" || failed[1] != "b" {
+		t.Errorf("Expected tokens of the failed batch, got: %v", failed)
+	}
+}
+
+func TestSync_FinalRunWorksAfterClientContextIsCancelled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	mr.SAdd(chatChangesKey, "abc")
+	mr.Set("chat_counter:abc", "7")
+
+	// As in main, the client and the scheduler share the process context
+	ctx, cancel := context.WithCancel(context.Background())
+	cs := NewCountSync(&database.DB{DB: db}, database.NewRedisClient(client, ctx), config.CountSyncConfig{})
+
+	scheduler := NewScheduler()
+	if err := scheduler.Add(Job{Name: "count_sync", Schedule: "@every 1h", RunOnStop: true, Run: cs.Sync}); err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec(`UPDATE applications`).WithArgs("abc", 7, "abc").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	cancel()
+	scheduler.stop(ctx, scheduler.jobs[0])
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Expected the final run to write the count: %v", err)
+	}
+	if status := scheduler.Status()[0]; status.LastError != "" {
+		t.Errorf("Expected the final run to succeed, got: %s", status.LastError)
+	}
+	if mr.Exists(chatChangesKey) || mr.Exists(chatChangesKey+processingSuffix) {
+		t.Error("Expected the change set to be drained")
+	}
+}
@@ -0,0 +1,296 @@
+package cron
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chat/writer/internal/database"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrLeadershipLost is the cancellation cause of a job's context once its
+// lease expired or was taken over by another instance.
+var ErrLeadershipLost = errors.New("leadership lost")
+
+// releaseTimeout bounds releasing the lease on shutdown, when the process
+// context is already cancelled.
+const releaseTimeout = 5 * time.Second
+
+// acquireScript takes the lease if nobody holds it and returns a new fencing
+// token, or 0 if the lease is held. The lease value is "<id>:<token>".
+var acquireScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. token, 'PX', ARGV[2])
+return token
+`)
+
+// renewScript extends the lease only if it still holds ARGV[1].
+var renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes the lease only if it still holds ARGV[1].
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Leader runs a job on exactly one writer instance at a time using a Redis
+// lease. The lease expires after ttl unless renewed, so when the leader dies
+// another instance takes over within ttl.
+//
+// Every acquisition gets a fencing token from a counter that only grows. The
+// token is part of the lease value, so an instance that stalled past its
+// lease can neither renew nor release the lease of the instance that took
+// over, and Fenced rejects its MySQL writes once a newer token wrote.
+type Leader struct {
+	redisClient *database.RedisClient
+	key         string
+	id          string
+	ttl         time.Duration
+
+	mu    sync.Mutex
+	value string // lease value while leading, empty otherwise
+	token int64  // fencing token while leading, 0 otherwise
+}
+
+func NewLeader(redisClient *database.RedisClient, name string, ttl time.Duration) *Leader {
+	return &Leader{
+		redisClient: redisClient,
+		key:         "leader:" + name,
+		id:          instanceID(),
+		ttl:         ttl,
+	}
+}
+
+// instanceID identifies this process in lease values and logs.
+func instanceID() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// Run campaigns for the lease until ctx is cancelled and runs job while it
+// holds it. job's context is cancelled with ErrLeadershipLost when the lease
+// can't be renewed, and Run campaigns again once job has returned. On
+// shutdown job is cancelled, allowed to finish, and the lease is released so
+// another instance takes over immediately.
+func (l *Leader) Run(ctx context.Context, job func(ctx context.Context)) {
+	interval := l.ttl / 3
+
+	for {
+		token, err := l.acquire(ctx)
+		if err != nil {
+			slog.Error("Failed to acquire lease", "lease", l.key, "error", err)
+		} else if token > 0 {
+			slog.Info("Acquired lease", "lease", l.key, "instance", l.id, "fencing_token", token)
+			l.lead(ctx, interval, job)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// lead runs job and renews the lease every interval until ctx is done or the
+// lease is lost.
+func (l *Leader) lead(ctx context.Context, interval time.Duration, job func(ctx context.Context)) {
+	jobCtx, cancel := context.WithCancelCause(withLease(ctx, l))
+	defer cancel(nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		job(jobCtx)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	renewed := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			l.release(ctx)
+			return
+		case <-done:
+			l.release(ctx)
+			return
+		case <-ticker.C:
+			ok, err := l.renew(ctx)
+			if err == nil && ok {
+				renewed = time.Now()
+				continue
+			}
+			if err != nil && time.Since(renewed) < l.ttl {
+				// Redis hiccup - the lease is still ours until it expires
+				slog.Warn("Failed to renew lease, retrying", "lease", l.key, "error", err)
+				continue
+			}
+			slog.Warn("Lost lease, stopping job", "lease", l.key)
+			cancel(ErrLeadershipLost)
+			<-done
+			l.clear()
+			return
+		}
+	}
+}
+
+func (l *Leader) acquire(ctx context.Context) (int64, error) {
+	token, err := acquireScript.Run(ctx, l.redisClient.Client,
+		[]string{l.key, l.key + ":fencing"}, l.id, l.ttl.Milliseconds()).Int64()
+	if err != nil || token == 0 {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	l.value = l.id + ":" + strconv.FormatInt(token, 10)
+	l.token = token
+	l.mu.Unlock()
+	return token, nil
+}
+
+func (l *Leader) renew(ctx context.Context) (bool, error) {
+	n, err := renewScript.Run(ctx, l.redisClient.Client,
+		[]string{l.key}, l.leaseValue(), l.ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// release deletes the lease even once ctx is cancelled, since that is how
+// shutdown reaches it.
+func (l *Leader) release(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+	defer cancel()
+	if err := releaseScript.Run(ctx, l.redisClient.Client,
+		[]string{l.key}, l.leaseValue()).Err(); err != nil {
+		slog.Error("Failed to release lease", "lease", l.key, "error", err)
+	}
+	l.clear()
+}
+
+func (l *Leader) clear() {
+	l.mu.Lock()
+	l.value = ""
+	l.token = 0
+	l.mu.Unlock()
+}
+
+func (l *Leader) fencingToken() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.token
+}
+
+func (l *Leader) leaseValue() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.value
+}
+
+// verify checks that the lease in Redis is still the one this instance
+// acquired.
+func (l *Leader) verify(ctx context.Context) error {
+	value := l.leaseValue()
+	if value == "" {
+		return ErrLeadershipLost
+	}
+	current, err := l.redisClient.WithContext(ctx).GetString(l.key)
+	if err == redis.Nil || (err == nil && current != value) {
+		return ErrLeadershipLost
+	}
+	return err
+}
+
+type leaseKey struct{}
+
+func withLease(ctx context.Context, l *Leader) context.Context {
+	return context.WithValue(ctx, leaseKey{}, l)
+}
+
+// VerifyLease returns ErrLeadershipLost if ctx belongs to a job run by a
+// Leader that no longer holds its lease. It is a cheap check for jobs to stop
+// early; it can't fence a write made after it, use Fenced for that. Contexts
+// not started by a Leader always verify.
+func VerifyLease(ctx context.Context) error {
+	l, ok := ctx.Value(leaseKey{}).(*Leader)
+	if !ok {
+		return nil
+	}
+	return l.verify(ctx)
+}
+
+// Execer runs a statement on a connection pool or a transaction.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// fenceQuery records the token in cron_fences unless a newer one is already
+// there. It locks the row until the transaction ends, so the check and the
+// writes that follow are atomic with respect to other leaders.
+const fenceQuery = `
+	INSERT INTO cron_fences (name, token) VALUES (?, ?)
+	ON DUPLICATE KEY UPDATE token = GREATEST(token, VALUES(token))
+`
+
+// Fenced runs fn in a MySQL transaction carrying the fencing token of the
+// Leader running ctx's job. If a newer leader already wrote, fn isn't run and
+// ErrLeadershipLost is returned; a newer leader writing meanwhile waits for
+// the transaction to end. Contexts not started by a Leader run fn on db
+// directly.
+func Fenced(ctx context.Context, db *database.DB, fn func(exec Execer) error) error {
+	l, ok := ctx.Value(leaseKey{}).(*Leader)
+	if !ok {
+		return fn(db)
+	}
+	token := l.fencingToken()
+	if token == 0 {
+		return ErrLeadershipLost
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fenceQuery, l.key, token); err != nil {
+		return fmt.Errorf("failed to record fencing token: %w", err)
+	}
+	var newest int64
+	if err := tx.QueryRowContext(ctx, `SELECT token FROM cron_fences WHERE name = ?`, l.key).Scan(&newest); err != nil {
+		return fmt.Errorf("failed to read fencing token: %w", err)
+	}
+	if newest != token {
+		return ErrLeadershipLost
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
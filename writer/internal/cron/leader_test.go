@@ -0,0 +1,200 @@
+package cron
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chat/writer/internal/database"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestLeaders(t *testing.T, n int, ttl time.Duration) ([]*Leader, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	redisClient := database.NewRedisClient(client, context.Background())
+	leaders := make([]*Leader, n)
+	for i := range leaders {
+		leaders[i] = NewLeader(redisClient, "test", ttl)
+	}
+	return leaders, mr
+}
+
+func TestLeader_OnlyOneInstanceAcquiresLease(t *testing.T) {
+	leaders, _ := newTestLeaders(t, 2, time.Second)
+
+	first, err := leaders[0].acquire(context.Background())
+	if err != nil || first == 0 {
+		t.Fatalf("Expected first instance to acquire the lease, got token %d: %v", first, err)
+	}
+	second, err := leaders[1].acquire(context.Background())
+	if err != nil || second != 0 {
+		t.Errorf("Expected second instance to be refused, got token %d: %v", second, err)
+	}
+}
+
+func TestLeader_TakeoverAfterLeaderDiesGetsNewerToken(t *testing.T) {
+	leaders, mr := newTestLeaders(t, 2, time.Second)
+
+	first, _ := leaders[0].acquire(context.Background())
+	// The leader stops renewing and the lease expires
+	mr.FastForward(time.Second)
+
+	second, err := leaders[1].acquire(context.Background())
+	if err != nil || second <= first {
+		t.Fatalf("Expected takeover with a newer fencing token than %d, got %d: %v", first, second, err)
+	}
+
+	if ok, _ := leaders[0].renew(context.Background()); ok {
+		t.Error("Expected the former leader to be unable to renew")
+	}
+	if err := leaders[0].verify(context.Background()); !errors.Is(err, ErrLeadershipLost) {
+		t.Errorf("Expected the former leader to fail verification, got: %v", err)
+	}
+	if err := leaders[1].verify(context.Background()); err != nil {
+		t.Errorf("Expected the new leader to verify, got: %v", err)
+	}
+}
+
+func TestLeader_CancelsJobWhenLeaseIsLost(t *testing.T) {
+	leaders, mr := newTestLeaders(t, 1, 30*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	causes := make(chan error, 1)
+	go leaders[0].Run(ctx, func(jobCtx context.Context) {
+		// Another instance took over while this one was stalled
+		mr.Set("leader:test", "someone-else:99")
+		<-jobCtx.Done()
+		causes <- context.Cause(jobCtx)
+	})
+
+	select {
+	case cause := <-causes:
+		if !errors.Is(cause, ErrLeadershipLost) {
+			t.Errorf("Expected ErrLeadershipLost, got: %v", cause)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the job to be cancelled")
+	}
+}
+
+func TestLeader_ReleasesLeaseOnShutdown(t *testing.T) {
+	leaders, mr := newTestLeaders(t, 1, time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		leaders[0].Run(ctx, func(jobCtx context.Context) {
+			close(started)
+			<-jobCtx.Done()
+		})
+		close(stopped)
+	}()
+
+	<-started
+	cancel()
+	<-stopped
+
+	if mr.Exists("leader:test") {
+		t.Error("Expected the lease to be released on shutdown")
+	}
+}
+
+func TestLeader_ReleasesLeaseWhenClientContextIsCancelled(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	// As in main, the client and Run share the process context
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := NewLeader(database.NewRedisClient(client, ctx), "test", time.Second)
+
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		leader.Run(ctx, func(jobCtx context.Context) {
+			close(started)
+			<-jobCtx.Done()
+		})
+		close(stopped)
+	}()
+
+	<-started
+	cancel()
+	<-stopped
+
+	if mr.Exists("leader:test") {
+		t.Error("Expected the lease to be released after the client's context was cancelled")
+	}
+}
+
+func newFencedTest(t *testing.T, token int64) (context.Context, *database.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	leaders, _ := newTestLeaders(t, 1, time.Second)
+	leaders[0].token = token
+	return withLease(context.Background(), leaders[0]), &database.DB{DB: db}, mock
+}
+
+func TestFenced_WritesWithCurrentToken(t *testing.T) {
+	ctx, db, mock := newFencedTest(t, 7)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO cron_fences`).WithArgs("leader:test", int64(7)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(`SELECT token FROM cron_fences`).WillReturnRows(sqlmock.NewRows([]string{"token"}).AddRow(7))
+	mock.ExpectExec(`UPDATE applications`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := Fenced(ctx, db, func(exec Execer) error {
+		_, err := exec.ExecContext(ctx, `UPDATE applications SET chats_count = 3`)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestFenced_RejectsStaleToken(t *testing.T) {
+	ctx, db, mock := newFencedTest(t, 7)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO cron_fences`).WillReturnResult(sqlmock.NewResult(0, 0))
+	// A newer leader already wrote
+	mock.ExpectQuery(`SELECT token FROM cron_fences`).WillReturnRows(sqlmock.NewRows([]string{"token"}).AddRow(8))
+	mock.ExpectRollback()
+
+	err := Fenced(ctx, db, func(exec Execer) error {
+		t.Error("Expected the write to be skipped")
+		return nil
+	})
+	if !errors.Is(err, ErrLeadershipLost) {
+		t.Errorf("Expected ErrLeadershipLost, got: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestFenced_RejectsAfterLeaseLost(t *testing.T) {
+	ctx, db, _ := newFencedTest(t, 0)
+	err := Fenced(ctx, db, func(exec Execer) error {
+		t.Error("Expected the write to be skipped")
+		return nil
+	})
+	if !errors.Is(err, ErrLeadershipLost) {
+		t.Errorf("Expected ErrLeadershipLost, got: %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package cron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/logging"
+)
+
+const (
+	ReconcileReport = "report"
+	ReconcileRepair = "repair"
+)
+
+// Reconciler compares applications.chats_count,
+// chats.messages_count and their Redis counters against the rows in MySQL.
+//
+// The counters hand out chat and message numbers, so a counter is expected to
+// be ahead of COUNT(*) when a create dead-lettered or a row was hard-deleted.
+// That drift is only reported: lowering a counter would hand out a number
+// that may still be in flight. A counter below the highest number in use is
+// the dangerous case (the next number would collide), and in repair mode it
+// is raised to that number.
+type Reconciler struct {
+	db          *database.DB
+	redisClient *database.RedisClient
+	cfg         config.ReconcileConfig
+}
+
+// ReconcileResult summarises the reconciliation of one table.
+type ReconcileResult struct {
+	Checked  int
+	Drifted  int
+	Behind   int
+	Repaired int
+}
+
+// countCheck is one stored count compared against the rows it counts. number
+// is zero for applications.
+type countCheck struct {
+	id         int64
+	token      string
+	number     int
+	stored     int
+	counter    int
+	hasCounter bool
+	rows       int
+	maxNumber  int
+}
+
+func (c countCheck) key() string {
+	if c.number == 0 {
+		return c.token
+	}
+	return fmt.Sprintf("%s:%d", c.token, c.number)
+}
+
+func (c countCheck) drifted() bool {
+	return c.stored != c.rows || (c.hasCounter && c.counter != c.rows)
+}
+
+func (c countCheck) behind() bool {
+	return c.stored < c.maxNumber || (c.hasCounter && c.counter < c.maxNumber)
+}
+
+// countTable describes how to reconcile the counts stored on one table.
+type countTable struct {
+	kind string
+	// list selects id, token, number and the stored count of up to ? owners after id ?
+	list string
+	// rows selects token, number, COUNT(*) and MAX(number) of the counted rows of checks
+	rows       func(checks []countCheck) (string, []interface{})
+	counterKey func(c countCheck) string
+	// repair raises the stored count of the owner with id ? to ?
+	repair string
+}
+
+var chatCounts = countTable{
+	kind: "chat",
+	list: `
+		SELECT id, token, number, messages_count
+		FROM chats
+		WHERE id > ?
+		ORDER BY id
+		LIMIT ?
+	`,
+	rows: func(checks []countCheck) (string, []interface{}) {
+		placeholders := make([]string, len(checks))
+		args := make([]interface{}, 0, len(checks)*2)
+		for i, c := range checks {
+			placeholders[i] = "(?, ?)"
+			args = append(args, c.token, c.number)
+		}
+		// Tombstones keep their numbers, so soft-deleted rows are counted
+		return fmt.Sprintf(`
+		SELECT token, chat_number, COUNT(*), COALESCE(MAX(number), 0)
+		FROM messages
+		WHERE (token, chat_number) IN (%s)
+		GROUP BY token, chat_number
+	`, strings.Join(placeholders, ", ")), args
+	},
+	counterKey: func(c countCheck) string {
+		return fmt.Sprintf("message_counter:%s:%d", c.token, c.number)
+	},
+	repair: `
+		UPDATE chats
+		SET messages_count = GREATEST(messages_count, ?)
+		WHERE id = ?
+	`,
+}
+
+var applicationCounts = countTable{
+	kind: "application",
+	list: `
+		SELECT id, token, 0, chats_count
+		FROM applications
+		WHERE id > ?
+		ORDER BY id
+		LIMIT ?
+	`,
+	rows: func(checks []countCheck) (string, []interface{}) {
+		placeholders := make([]string, len(checks))
+		args := make([]interface{}, len(checks))
+		for i, c := range checks {
+			placeholders[i] = "?"
+			args[i] = c.token
+		}
+		return fmt.Sprintf(`
+		SELECT token, 0, COUNT(*), COALESCE(MAX(number), 0)
+		FROM chats
+		WHERE token IN (%s)
+		GROUP BY token
+	`, strings.Join(placeholders, ", ")), args
+	},
+	counterKey: func(c countCheck) string {
+		return "chat_counter:" + c.token
+	},
+	repair: `
+		UPDATE applications
+		SET chats_count = GREATEST(chats_count, ?)
+		WHERE id = ?
+	`,
+}
+
+func NewReconciler(db *database.DB, redisClient *database.RedisClient, cfg config.ReconcileConfig) *Reconciler {
+	if cfg.ChunkSize < 1 {
+		cfg.ChunkSize = 500
+	}
+	return &Reconciler{
+		db:          db,
+		redisClient: redisClient,
+		cfg:         cfg,
+	}
+}
+
+// Reconcile checks application counts, then chat counts, and logs a summary
+// of each. It is run by the scheduler.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	var errs []error
+	for _, table := range []countTable{applicationCounts, chatCounts} {
+		result, err := r.reconcileTable(ctx, table)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to reconcile %s counts: %w", table.kind, err))
+			continue
+		}
+		logging.FromContext(ctx).Info("Reconciled counts", "kind", table.kind, "checked", result.Checked,
+			"drifted", result.Drifted, "behind", result.Behind, "repaired", result.Repaired)
+	}
+	return errors.Join(errs...)
+}
+
+// reconcileTable walks table in chunks of cfg.ChunkSize owners, logging every
+// count that fell behind at Warn (other drift at Debug) and, in repair mode,
+// raising it.
+func (r *Reconciler) reconcileTable(ctx context.Context, table countTable) (ReconcileResult, error) {
+	var result ReconcileResult
+	var lastID int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		checks, err := r.loadChunk(ctx, table, lastID)
+		if err != nil {
+			return result, err
+		}
+		if len(checks) == 0 {
+			return result, nil
+		}
+		lastID = checks[len(checks)-1].id
+
+		for _, c := range checks {
+			result.Checked++
+			if !c.drifted() && !c.behind() {
+				continue
+			}
+			result.Drifted++
+			if !c.behind() {
+				// Counts ahead of the rows are expected and stay that way
+				// after a hard delete, so they'd be logged on every run
+				logging.FromContext(ctx).Debug("Count drifted", "kind", table.kind, "key", c.key(), "stored", c.stored,
+					"redis", formatCounter(c), "rows", c.rows, "max_number", c.maxNumber)
+				continue
+			}
+			result.Behind++
+			logging.FromContext(ctx).Warn("Count behind highest number", "kind", table.kind, "key", c.key(), "stored", c.stored,
+				"redis", formatCounter(c), "rows", c.rows, "max_number", c.maxNumber)
+			if r.cfg.Mode != ReconcileRepair {
+				continue
+			}
+			if err := r.repair(ctx, table, c); err != nil {
+				return result, fmt.Errorf("failed to repair %s %s: %w", table.kind, c.key(), err)
+			}
+			result.Repaired++
+		}
+
+		if len(checks) < r.cfg.ChunkSize {
+			return result, nil
+		}
+	}
+}
+
+// loadChunk loads the next chunk of owners after lastID with their row counts
+// and Redis counters.
+func (r *Reconciler) loadChunk(ctx context.Context, table countTable, lastID int64) ([]countCheck, error) {
+	owners, err := r.db.QueryContext(ctx, table.list, lastID, r.cfg.ChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %ss: %w", table.kind, err)
+	}
+	defer owners.Close()
+
+	var checks []countCheck
+	index := make(map[string]int)
+	for owners.Next() {
+		var c countCheck
+		if err := owners.Scan(&c.id, &c.token, &c.number, &c.stored); err != nil {
+			return nil, err
+		}
+		index[c.key()] = len(checks)
+		checks = append(checks, c)
+	}
+	if err := owners.Err(); err != nil {
+		return nil, err
+	}
+	if len(checks) == 0 {
+		return nil, nil
+	}
+
+	query, args := table.rows(checks)
+	counts, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count %s rows: %w", table.kind, err)
+	}
+	defer counts.Close()
+
+	for counts.Next() {
+		var c countCheck
+		if err := counts.Scan(&c.token, &c.number, &c.rows, &c.maxNumber); err != nil {
+			return nil, err
+		}
+		if i, ok := index[c.key()]; ok {
+			checks[i].rows = c.rows
+			checks[i].maxNumber = c.maxNumber
+		}
+	}
+	if err := counts.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(checks))
+	for i, c := range checks {
+		keys[i] = table.counterKey(c)
+	}
+	counters, err := r.redisClient.WithContext(ctx).GetInts(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s counters: %w", table.kind, err)
+	}
+	for i, key := range keys {
+		checks[i].counter, checks[i].hasCounter = counters[key]
+	}
+
+	return checks, nil
+}
+
+// repair raises the Redis counter first, so the count sync can't copy the old
+// value back over the repaired row. A missing counter is left alone: the API
+// seeds it from the repaired row.
+func (r *Reconciler) repair(ctx context.Context, table countTable, c countCheck) error {
+	if err := VerifyLease(ctx); err != nil {
+		return err
+	}
+
+	if c.hasCounter && c.counter < c.maxNumber {
+		if _, err := r.redisClient.WithContext(ctx).RaiseCounter(table.counterKey(c), c.maxNumber); err != nil {
+			return err
+		}
+	}
+
+	if c.stored < c.maxNumber {
+		err := Fenced(ctx, r.db, func(exec Execer) error {
+			_, err := exec.ExecContext(ctx, table.repair, c.maxNumber, c.id)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	logging.FromContext(ctx).Info("Raised counts", "kind", table.kind, "key", c.key(), "to", c.maxNumber)
+	return nil
+}
+
+func formatCounter(c countCheck) string {
+	if !c.hasCounter {
+		return "missing"
+	}
+	return fmt.Sprint(c.counter)
+}
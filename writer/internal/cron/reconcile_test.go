@@ -0,0 +1,133 @@
+package cron
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/logging"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestReconciler(t *testing.T, mode string, chunkSize int) (*Reconciler, *miniredis.Miniredis, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	r := NewReconciler(&database.DB{DB: db}, database.NewRedisClient(client, context.Background()),
+		config.ReconcileConfig{Mode: mode, ChunkSize: chunkSize})
+	return r, mr, mock
+}
+
+// expectChatChunk expects one chunk of two chats: abc:1 is in sync, abc:2 has
+// a stored count and counter behind its highest message number.
+func expectChatChunk(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT id, token, number, messages_count\s+FROM chats\s+WHERE id > \?\s+ORDER BY id\s+LIMIT \?`).
+		WithArgs(0, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token", "number", "messages_count"}).
+			AddRow(10, "abc", 1, 3).
+			AddRow(11, "abc", 2, 1))
+	mock.ExpectQuery(`SELECT token, chat_number, COUNT\(\*\), COALESCE\(MAX\(number\), 0\)\s+FROM messages\s+WHERE \(token, chat_number\) IN \(\(\?, \?\), \(\?, \?\)\)`).
+		WithArgs("abc", 1, "abc", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"token", "chat_number", "count", "max"}).
+			AddRow("abc", 1, 3, 3).
+			AddRow("abc", 2, 4, 5))
+}
+
+func TestReconcile_ReportModeOnlyReports(t *testing.T) {
+	r, mr, mock := newTestReconciler(t, ReconcileReport, 2)
+	mr.Set("message_counter:abc:1", "3")
+	mr.Set("message_counter:abc:2", "2")
+
+	expectChatChunk(mock)
+	mock.ExpectQuery(`SELECT id, token, number, messages_count`).
+		WithArgs(11, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token", "number", "messages_count"}))
+
+	result, err := r.reconcileTable(context.Background(), chatCounts)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.Checked != 2 || result.Drifted != 1 || result.Behind != 1 || result.Repaired != 0 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if counter, _ := mr.Get("message_counter:abc:2"); counter != "2" {
+		t.Errorf("Expected the counter to be left alone, got %s", counter)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestReconcile_RepairModeRaisesCountsBehind(t *testing.T) {
+	r, mr, mock := newTestReconciler(t, ReconcileRepair, 2)
+	mr.Set("message_counter:abc:1", "3")
+	mr.Set("message_counter:abc:2", "2")
+
+	expectChatChunk(mock)
+	mock.ExpectExec(`UPDATE chats\s+SET messages_count = GREATEST\(messages_count, \?\)\s+WHERE id = \?`).
+		WithArgs(5, 11).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT id, token, number, messages_count`).
+		WithArgs(11, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token", "number", "messages_count"}))
+
+	result, err := r.reconcileTable(context.Background(), chatCounts)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.Repaired != 1 {
+		t.Errorf("Expected one repair, got: %+v", result)
+	}
+	if counter, _ := mr.Get("message_counter:abc:2"); counter != "5" {
+		t.Errorf("Expected the counter to be raised to 5, got %s", counter)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestReconcile_CounterAheadOfRowsIsNotLowered(t *testing.T) {
+	r, mr, mock := newTestReconciler(t, ReconcileRepair, 10)
+	// Message 3 dead-lettered, so the counter is ahead of the rows
+	mr.Set("chat_counter:abc", "3")
+
+	mock.ExpectQuery(`SELECT id, token, 0, chats_count\s+FROM applications`).
+		WithArgs(0, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "token", "number", "chats_count"}).AddRow(1, "abc", 0, 3))
+	mock.ExpectQuery(`SELECT token, 0, COUNT\(\*\), COALESCE\(MAX\(number\), 0\)\s+FROM chats\s+WHERE token IN \(\?\)`).
+		WithArgs("abc").
+		WillReturnRows(sqlmock.NewRows([]string{"token", "number", "count", "max"}).AddRow("abc", 0, 2, 2))
+
+	var buf bytes.Buffer
+	ctx := logging.NewContext(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)))
+	result, err := r.reconcileTable(ctx, applicationCounts)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.Drifted != 1 || result.Behind != 0 || result.Repaired != 0 {
+		t.Errorf("Expected drift to be reported without repair, got: %+v", result)
+	}
+	// It stays ahead on every run, so it isn't worth a warning each time
+	if strings.Contains(buf.String(), "WARN") {
+		t.Errorf("Expected no warning for a count ahead of the rows, got %q", buf.String())
+	}
+	if counter, _ := mr.Get("chat_counter:abc"); counter != "3" {
+		t.Errorf("Expected the counter to stay at 3, got %s", counter)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
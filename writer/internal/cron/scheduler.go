@@ -0,0 +1,231 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chat/writer/internal/logging"
+	"github.com/chat/writer/internal/metrics"
+	"github.com/chat/writer/internal/tracing"
+	robfig "github.com/robfig/cron/v3"
+)
+
+// Job is a named periodic task hosted by a Scheduler.
+type Job struct {
+	Name string
+	// Schedule is a standard five-field cron expression ("*/5 * * * *") or a
+	// descriptor such as "@hourly" or "@every 10s".
+	Schedule string
+	// Jitter delays every run by a random duration below it, so replicas and
+	// jobs sharing a schedule don't all hit the database at once.
+	Jitter time.Duration
+	// RunOnStart runs the job as soon as the scheduler starts.
+	RunOnStart bool
+	// RunOnStop runs the job once more on shutdown, e.g. to flush pending
+	// changes. It is skipped when the scheduler stopped because leadership
+	// was lost.
+	RunOnStop bool
+	Run       func(ctx context.Context) error
+}
+
+// JobStatus describes the runs of one job.
+type JobStatus struct {
+	Name         string
+	Schedule     string
+	Running      bool
+	Runs         int
+	Failures     int
+	Skipped      int
+	LastStart    time.Time
+	LastDuration time.Duration
+	LastError    string
+	Next         time.Time
+}
+
+// Scheduler runs jobs on their schedules. Each job runs in its own goroutine
+// and never overlaps itself: schedule slots that pass while a run is still
+// going are skipped and counted.
+type Scheduler struct {
+	jobs []*scheduledJob
+}
+
+type scheduledJob struct {
+	Job
+	parsed robfig.Schedule
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// Add registers job. It must be called before Start.
+func (s *Scheduler) Add(job Job) error {
+	schedule, err := parseSchedule(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q for job %s: %w", job.Schedule, job.Name, err)
+	}
+
+	s.jobs = append(s.jobs, &scheduledJob{
+		Job:    job,
+		parsed: schedule,
+		status: JobStatus{Name: job.Name, Schedule: job.Schedule},
+	})
+	return nil
+}
+
+// Start runs every job until ctx is cancelled and then waits for running jobs
+// and RunOnStop runs to finish.
+func (s *Scheduler) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, job := range s.jobs {
+		wg.Add(1)
+		go func(job *scheduledJob) {
+			defer wg.Done()
+			s.loop(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+}
+
+// Status returns the status of every job, sorted by name.
+func (s *Scheduler) Status() []JobStatus {
+	statuses := make([]JobStatus, len(s.jobs))
+	for i, job := range s.jobs {
+		job.mu.Lock()
+		statuses[i] = job.status
+		job.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (s *Scheduler) loop(ctx context.Context, job *scheduledJob) {
+	slog.Info("Starting cron job", "job", job.Name, "schedule", job.Schedule, "jitter", job.Jitter)
+
+	if job.RunOnStart {
+		s.run(ctx, job)
+	}
+
+	for {
+		next := job.parsed.Next(time.Now())
+		job.mu.Lock()
+		job.status.Next = next
+		job.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next) + jitter(job.Jitter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.stop(ctx, job)
+			return
+		case <-timer.C:
+		}
+
+		s.run(ctx, job)
+	}
+}
+
+func (s *Scheduler) stop(ctx context.Context, job *scheduledJob) {
+	if !job.RunOnStop {
+		return
+	}
+	if context.Cause(ctx) == ErrLeadershipLost {
+		// Another instance runs the job now
+		slog.Info("Leadership lost, skipping final run", "job", job.Name)
+		return
+	}
+
+	slog.Info("Final run of cron job", "job", job.Name)
+	s.run(context.WithoutCancel(ctx), job)
+}
+
+// run executes job once and records the outcome in its status and metrics.
+// The job logs through the logger carried by ctx, which adds the job name,
+// and runs under its own span.
+func (s *Scheduler) run(ctx context.Context, job *scheduledJob) {
+	ctx = logging.With(ctx, slog.String("job", job.Name))
+	ctx, span := tracing.Tracer().Start(ctx, "cron "+job.Name)
+	start := time.Now()
+	job.mu.Lock()
+	job.status.Running = true
+	job.status.LastStart = start
+	job.mu.Unlock()
+
+	err := job.Run(ctx)
+	tracing.End(span, err)
+
+	end := time.Now()
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.status.Running = false
+	job.status.Runs++
+	job.status.LastDuration = end.Sub(start)
+	job.status.LastError = ""
+	if err != nil {
+		job.status.Failures++
+		job.status.LastError = err.Error()
+		metrics.CronRunsTotal.WithLabelValues(job.Name, "failed").Inc()
+		metrics.CronLastRunFailed.WithLabelValues(job.Name).Set(1)
+		logging.FromContext(ctx).Error("Cron job failed", "duration", job.status.LastDuration, "error", err)
+	} else {
+		metrics.CronRunsTotal.WithLabelValues(job.Name, "succeeded").Inc()
+		metrics.CronLastRunFailed.WithLabelValues(job.Name).Set(0)
+		metrics.CronLastSuccess.WithLabelValues(job.Name).Set(float64(end.Unix()))
+	}
+
+	// Slots that passed while the job was running are skipped, not queued up
+	if skipped := missedSlots(job.parsed, start, end); skipped > 0 {
+		job.status.Skipped += skipped
+		metrics.CronSkippedTotal.WithLabelValues(job.Name).Add(float64(skipped))
+		logging.FromContext(ctx).Warn("Cron job overran its schedule", "skipped", skipped)
+	}
+}
+
+// parseSchedule parses a cron expression or descriptor. "@every" is handled
+// here because the cron package rounds its interval to whole seconds.
+func parseSchedule(spec string) (robfig.Schedule, error) {
+	if value, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("interval must be positive")
+		}
+		return every(interval), nil
+	}
+	return robfig.ParseStandard(spec)
+}
+
+// every activates at a fixed interval after the previous activation.
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// missedSlots counts schedule activations in (start, end], up to a bound so a
+// very frequent schedule can't spin here.
+func missedSlots(schedule robfig.Schedule, start, end time.Time) int {
+	missed := 0
+	for t := schedule.Next(start); !t.After(end) && missed < 1000; t = schedule.Next(t) {
+		missed++
+	}
+	return missed
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
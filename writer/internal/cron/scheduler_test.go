@@ -0,0 +1,165 @@
+package cron
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chat/writer/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScheduler_RejectsInvalidSchedule(t *testing.T) {
+	s := NewScheduler()
+	err := s.Add(Job{Name: "broken", Schedule: "every ten seconds", Run: func(ctx context.Context) error { return nil }})
+	if err == nil {
+		t.Error("Expected an invalid schedule to be rejected")
+	}
+}
+
+func TestScheduler_RunsJobsAndRecordsStatus(t *testing.T) {
+	s := NewScheduler()
+	var runs atomic.Int32
+	s.Add(Job{
+		Name:       "ok",
+		Schedule:   "@every 10ms",
+		RunOnStart: true,
+		Run: func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		},
+	})
+	s.Add(Job{
+		Name:       "failing",
+		Schedule:   "@every 1h",
+		RunOnStart: true,
+		Run:        func(ctx context.Context) error { return errors.New("boom") },
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 55*time.Millisecond)
+	defer cancel()
+	s.Start(ctx)
+
+	statuses := s.Status()
+	if len(statuses) != 2 || statuses[0].Name != "failing" || statuses[1].Name != "ok" {
+		t.Fatalf("Expected statuses sorted by name, got: %+v", statuses)
+	}
+	if statuses[0].Failures != 1 || statuses[0].LastError != "boom" {
+		t.Errorf("Expected the failure to be recorded, got: %+v", statuses[0])
+	}
+	if statuses[1].Runs < 3 || int(runs.Load()) != statuses[1].Runs {
+		t.Errorf("Expected several recorded runs, got %d (status: %+v)", runs.Load(), statuses[1])
+	}
+
+	if got := testutil.ToFloat64(metrics.CronLastRunFailed.WithLabelValues("failing")); got != 1 {
+		t.Errorf("Expected the failing job to be exported as failed, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.CronRunsTotal.WithLabelValues("ok", "succeeded")); int(got) != statuses[1].Runs {
+		t.Errorf("Expected %d successful runs exported, got %v", statuses[1].Runs, got)
+	}
+	if got := testutil.ToFloat64(metrics.CronLastSuccess.WithLabelValues("ok")); got < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Errorf("Expected a recent last success time, got %v", got)
+	}
+}
+
+func TestScheduler_JobNeverOverlapsItself(t *testing.T) {
+	s := NewScheduler()
+	var running, maxRunning atomic.Int32
+	s.Add(Job{
+		Name:       "slow",
+		Schedule:   "@every 5ms",
+		RunOnStart: true,
+		Run: func(ctx context.Context) error {
+			n := running.Add(1)
+			if n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			time.Sleep(30 * time.Millisecond)
+			running.Add(-1)
+			return nil
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 70*time.Millisecond)
+	defer cancel()
+	s.Start(ctx)
+
+	if maxRunning.Load() != 1 {
+		t.Errorf("Expected at most one concurrent run, got %d", maxRunning.Load())
+	}
+	if status := s.Status()[0]; status.Skipped == 0 {
+		t.Errorf("Expected overrun slots to be skipped, got: %+v", status)
+	}
+}
+
+func TestScheduler_FinalRunSkippedWhenLeadershipLost(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		cause     error
+		wantFinal bool
+	}{
+		{"shutdown", nil, true},
+		{"leadership lost", ErrLeadershipLost, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewScheduler()
+			var runs atomic.Int32
+			s.Add(Job{
+				Name:      "flush",
+				Schedule:  "@every 1h",
+				RunOnStop: true,
+				Run: func(ctx context.Context) error {
+					runs.Add(1)
+					return nil
+				},
+			})
+
+			ctx, cancel := context.WithCancelCause(context.Background())
+			cancel(tc.cause)
+			s.Start(ctx)
+
+			if got := runs.Load() == 1; got != tc.wantFinal {
+				t.Errorf("Expected final run: %v, got %d run(s)", tc.wantFinal, runs.Load())
+			}
+		})
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	base := time.Date(2024, 1, 1, 10, 7, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		next time.Time
+	}{
+		{"@every 250ms", base.Add(250 * time.Millisecond)},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+	} {
+		schedule, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.spec, err)
+			continue
+		}
+		if next := schedule.Next(base); !next.Equal(tc.next) {
+			t.Errorf("%s: expected next run at %v, got %v", tc.spec, tc.next, next)
+		}
+	}
+
+	if _, err := parseSchedule("@every -1s"); err == nil {
+		t.Error("Expected a negative interval to be rejected")
+	}
+}
+
+func TestMissedSlots(t *testing.T) {
+	schedule, _ := parseSchedule("@every 10s")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if n := missedSlots(schedule, start, start.Add(5*time.Second)); n != 0 {
+		t.Errorf("Expected no missed slots, got %d", n)
+	}
+	if n := missedSlots(schedule, start, start.Add(35*time.Second)); n != 3 {
+		t.Errorf("Expected 3 missed slots, got %d", n)
+	}
+}
@@ -1,16 +1,164 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/XSAM/otelsql"
+	"github.com/chat/writer/internal/breaker"
+	"github.com/go-sql-driver/mysql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 )
 
+// ErDupEntry is MySQL's "Duplicate entry for key" error number.
+const ErDupEntry = 1062
+
+// DB is the MySQL connection pool. Every query, statement and transaction
+// goes through Breaker and fails fast with breaker.ErrOpen while MySQL is
+// considered down; PingContext doesn't, so health checks and the breaker's
+// probe still reach it. A nil Breaker lets every call through.
 type DB struct {
 	*sql.DB
+	Breaker *breaker.Breaker
+}
+
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	var tx *sql.Tx
+	err := db.Breaker.Do(func() (err error) {
+		tx, err = db.DB.BeginTx(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, breaker: db.Breaker}, nil
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (result sql.Result, err error) {
+	err = db.Breaker.Do(func() error {
+		result, err = db.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (rows *sql.Rows, err error) {
+	err = db.Breaker.Do(func() error {
+		rows, err = db.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRowContext fails fast like the other queries; the outcome is
+// recorded once the row is scanned.
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	if err := db.Breaker.Allow(); err != nil {
+		return &Row{err: err}
+	}
+	return &Row{Row: db.DB.QueryRowContext(ctx, query, args...), breaker: db.Breaker}
+}
+
+func (db *DB) PrepareContext(ctx context.Context, query string) (stmt *sql.Stmt, err error) {
+	err = db.Breaker.Do(func() error {
+		stmt, err = db.DB.PrepareContext(ctx, query)
+		return err
+	})
+	return stmt, err
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+func (db *DB) Prepare(query string) (*sql.Stmt, error) {
+	return db.PrepareContext(context.Background(), query)
+}
+
+// Tx is a transaction begun by DB. Its statements and Commit report their
+// outcome to the DB's Breaker but don't fail fast: the transaction already
+// holds a connection and is better finished or rolled back.
+type Tx struct {
+	*sql.Tx
+	breaker *breaker.Breaker
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	result, err := tx.Tx.ExecContext(ctx, query, args...)
+	tx.breaker.Record(err)
+	return result, err
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	tx.breaker.Record(err)
+	return rows, err
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
+	return &Row{Row: tx.Tx.QueryRowContext(ctx, query, args...), breaker: tx.breaker}
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *Row {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.breaker.Record(err)
+	return err
+}
+
+// Row is the result of QueryRowContext. Scan reports the query's outcome to
+// the breaker; sql.ErrNoRows counts as MySQL answering.
+type Row struct {
+	*sql.Row
+	breaker *breaker.Breaker
+	// err is set when the breaker refused the query
+	err error
+}
+
+func (r *Row) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	err := r.Row.Scan(dest...)
+	r.breaker.Record(err)
+	return err
+}
+
+func (r *Row) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Row.Err()
 }
 
 func Connect(host, user, password, dbName string) (*DB, error) {
@@ -21,7 +169,14 @@ func Connect(host, user, password, dbName string) (*DB, error) {
 
 	// Retry connection
 	for i := 0; i < 10; i++ {
-		db, err = sql.Open("mysql", dsn)
+		// Every query run with a context gets a span under the caller's
+		db, err = otelsql.Open("mysql", dsn,
+			otelsql.WithAttributes(semconv.DBSystemMySQL),
+			otelsql.WithSpanOptions(otelsql.SpanOptions{
+				DisableErrSkip:       true,
+				OmitConnResetSession: true,
+				OmitRows:             true,
+			}))
 		if err == nil {
 			err = db.Ping()
 			if err == nil {
@@ -31,13 +186,37 @@ func Connect(host, user, password, dbName string) (*DB, error) {
 				db.SetConnMaxLifetime(5 * time.Minute)
 				db.SetConnMaxIdleTime(2 * time.Minute)
 				
-				log.Println("Connected to MySQL with connection pool configured")
-				return &DB{db}, nil
+				slog.Info("Connected to MySQL with connection pool configured")
+				return &DB{DB: db}, nil
 			}
 		}
-		log.Printf("Failed to connect to MySQL, retrying in 2s... (%d/10)", i+1)
+		slog.Warn("Failed to connect to MySQL, retrying in 2s", "attempt", i+1, "max_attempts", 10, "error", err)
 		time.Sleep(2 * time.Second)
 	}
 
 	return nil, err
 }
+
+// IsUnavailable reports whether err means MySQL couldn't be reached or
+// refused more connections, as opposed to rejecting the statement itself.
+func IsUnavailable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_CON_COUNT_ERROR, ER_TOO_MANY_USER_CONNECTIONS
+		return mysqlErr.Number == 1040 || mysqlErr.Number == 1203
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsDuplicateKey reports whether err is a MySQL unique index violation.
+func IsDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == ErDupEntry
+}
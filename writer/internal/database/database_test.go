@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/chat/writer/internal/breaker"
+	"github.com/chat/writer/internal/config"
+)
+
+func newTestDB(t *testing.T) (*DB, sqlmock.Sqlmock) {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	b := breaker.New("test", config.BreakerConfig{FailureThreshold: 1, Cooldown: time.Hour},
+		func(ctx context.Context) error { return errors.New("still down") }, IsUnavailable)
+	return &DB{DB: sqlDB, Breaker: b}, mock
+}
+
+func TestTx_CommitErrorOpensBreaker(t *testing.T) {
+	db, mock := newTestDB(t)
+	ctx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE chats").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit().WillReturnError(driver.ErrBadConn)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("expected transaction, got %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chats SET messages_count = 1"); err != nil {
+		t.Fatalf("expected update to succeed, got %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, driver.ErrBadConn) {
+		t.Fatalf("expected commit to fail, got %v", err)
+	}
+
+	if db.Breaker.State() != breaker.Open {
+		t.Fatalf("expected breaker open after failed commit, got %s", db.Breaker.State())
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&n); !errors.Is(err, breaker.ErrOpen) {
+		t.Errorf("expected QueryRowContext to fail fast, got %v", err)
+	}
+	if _, err := db.Prepare("SELECT 1"); !errors.Is(err, breaker.ErrOpen) {
+		t.Errorf("expected Prepare to fail fast, got %v", err)
+	}
+}
+
+func TestRow_NoRowsDoesNotCountAsFailure(t *testing.T) {
+	db, mock := newTestDB(t)
+
+	mock.ExpectQuery("SELECT version").WillReturnRows(sqlmock.NewRows([]string{"version"}))
+
+	var version int
+	if err := db.QueryRow("SELECT version FROM messages").Scan(&version); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected no rows, got %v", err)
+	}
+	if db.Breaker.State() != breaker.Closed {
+		t.Errorf("expected breaker closed, got %s", db.Breaker.State())
+	}
+}
@@ -1,7 +1,9 @@
 package database
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
@@ -27,13 +29,26 @@ func ConnectElasticsearch(url string) (*ElasticsearchClient, error) {
 			res, err := client.Info()
 			if err == nil {
 				res.Body.Close()
-				log.Println("Connected to Elasticsearch")
+				slog.Info("Connected to Elasticsearch")
 				return &ElasticsearchClient{client}, nil
 			}
 		}
-		log.Printf("Failed to connect to Elasticsearch, retrying in 2s... (%d/10)", i+1)
+		slog.Warn("Failed to connect to Elasticsearch, retrying in 2s", "attempt", i+1, "max_attempts", 10)
 		time.Sleep(2 * time.Second)
 	}
 
 	return nil, err
 }
+
+// PingContext checks that the cluster answers.
+func (c *ElasticsearchClient) PingContext(ctx context.Context) error {
+	res, err := c.Ping(c.Ping.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("ping failed: %s", res.Status())
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package database
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
+	"strconv"
 
+	"github.com/chat/writer/internal/tracing"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -19,17 +22,29 @@ func ConnectRedis(redisURL string, ctx context.Context) (*RedisClient, error) {
 	}
 
 	client := redis.NewClient(opt)
+	client.AddHook(tracing.RedisHook{})
 
 	_, err = client.Ping(ctx).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println("Connected to Redis")
+	slog.Info("Connected to Redis")
+	return NewRedisClient(client, ctx), nil
+}
+
+// NewRedisClient wraps an existing client; ctx is used for every command.
+func NewRedisClient(client *redis.Client, ctx context.Context) *RedisClient {
 	return &RedisClient{
 		Client: client,
 		ctx:    ctx,
-	}, nil
+	}
+}
+
+// WithContext returns a copy of r that runs its commands with ctx, so they
+// are traced as part of the caller's span.
+func (r *RedisClient) WithContext(ctx context.Context) *RedisClient {
+	return NewRedisClient(r.Client, ctx)
 }
 
 func (r *RedisClient) GetInt(key string) (int, error) {
@@ -59,3 +74,97 @@ func (r *RedisClient) SMembers(key string) ([]string, error) {
 func (r *RedisClient) Del(keys ...string) error {
 	return r.Client.Del(r.ctx, keys...).Err()
 }
+
+func (r *RedisClient) SRem(key string, members ...any) error {
+	return r.Client.SRem(r.ctx, key, members...).Err()
+}
+
+// ScanKeys returns every key matching pattern using SCAN, so large keyspaces
+// don't block Redis the way KEYS would.
+func (r *RedisClient) ScanKeys(pattern string) ([]string, error) {
+	var keys []string
+	iter := r.Client.Scan(r.ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(r.ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// drainSetScript moves every member of KEYS[1] into KEYS[2] and returns the
+// members of KEYS[2]. KEYS[2] may still hold members left behind by a run
+// that crashed before finishing, so those are picked up again.
+var drainSetScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('SUNIONSTORE', KEYS[2], KEYS[2], KEYS[1])
+	redis.call('DEL', KEYS[1])
+end
+return redis.call('SMEMBERS', KEYS[2])
+`)
+
+// finishDrainScript re-adds ARGV to KEYS[1] and deletes KEYS[2]. Members are
+// added in chunks to stay below Lua's unpack limit.
+var finishDrainScript = redis.NewScript(`
+for i = 1, #ARGV, 1000 do
+	redis.call('SADD', KEYS[1], unpack(ARGV, i, math.min(i + 999, #ARGV)))
+end
+return redis.call('DEL', KEYS[2])
+`)
+
+// DrainSet atomically moves the members of key into processingKey and returns
+// them. Members added to key afterwards are kept for the next drain. Call
+// FinishDrain once the members have been processed.
+func (r *RedisClient) DrainSet(key, processingKey string) ([]string, error) {
+	return drainSetScript.Run(r.ctx, r.Client, []string{key, processingKey}).StringSlice()
+}
+
+// FinishDrain puts the members that failed to process back into key and
+// clears processingKey.
+func (r *RedisClient) FinishDrain(key, processingKey string, failed ...string) error {
+	args := make([]any, len(failed))
+	for i, member := range failed {
+		args[i] = member
+	}
+	return finishDrainScript.Run(r.ctx, r.Client, []string{key, processingKey}, args...).Err()
+}
+
+// GetInts reads several integer keys with one MGET. Missing keys are left out
+// of the result.
+func (r *RedisClient) GetInts(keys ...string) (map[string]int, error) {
+	values, err := r.Client.MGet(r.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int, len(keys))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is not an integer: %w", keys[i], err)
+		}
+		result[keys[i]] = n
+	}
+	return result, nil
+}
+
+// raiseScript sets KEYS[1] to ARGV[1] only if the key exists and holds a
+// smaller number.
+var raiseScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and tonumber(current) < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// RaiseCounter atomically raises an existing counter to at least value and
+// reports whether it changed. Counters are never lowered, and a missing
+// counter is left for its owner to seed.
+func (r *RedisClient) RaiseCounter(key string, value int) (bool, error) {
+	n, err := raiseScript.Run(r.ctx, r.Client, []string{key}, value).Int()
+	return n == 1, err
+}
@@ -0,0 +1,277 @@
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chat/writer/internal/queue"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Suffix is appended to a queue's name to get its dead letter queue.
+const Suffix = ".dlq"
+
+// Action is what Run does with the dead-lettered messages that match.
+type Action int
+
+const (
+	// Peek shows matching messages and leaves every message in the DLQ.
+	Peek Action = iota
+	// Replay republishes matching messages to their original queue with the
+	// retry headers reset, and removes them from the DLQ.
+	Replay
+	// Purge removes matching messages from the DLQ.
+	Purge
+)
+
+// deathHeaders are set by the broker when it dead-letters a message. They are
+// dropped on replay together with the writer's own retry headers.
+var deathHeaders = []string{
+	"x-death",
+	"x-first-death-exchange", "x-first-death-queue", "x-first-death-reason",
+	"x-last-death-exchange", "x-last-death-queue", "x-last-death-reason",
+}
+
+// Message is a dead-lettered delivery.
+type Message struct {
+	// Index is the message's position in the DLQ when the scan started, from 1
+	Index        int
+	RetryCount   int
+	FirstFailure time.Time // zero if the message never went through a retry
+	// Reason is the writer's classification of the last failure, e.g.
+	// "permanent: message_not_found", or why the broker dead-lettered it,
+	// e.g. "rejected"
+	Reason  string
+	Headers amqp.Table
+	Body    []byte
+	// Payload is Body decoded as a JSON object, nil if it isn't one
+	Payload map[string]any
+}
+
+func newMessage(index int, d amqp.Delivery) Message {
+	m := Message{
+		Index:   index,
+		Headers: d.Headers,
+		Body:    d.Body,
+	}
+	if count, ok := d.Headers[queue.RetryCountHeader].(int32); ok {
+		m.RetryCount = int(count)
+	}
+	if ts, ok := d.Headers[queue.FirstFailureHeader].(int64); ok {
+		m.FirstFailure = time.Unix(ts, 0)
+	}
+	if class, ok := d.Headers[queue.FailureClassHeader].(string); ok {
+		m.Reason = class
+		if reason, ok := d.Headers[queue.FailureReasonHeader].(string); ok {
+			m.Reason += ": " + reason
+		}
+	} else if reason, ok := d.Headers["x-first-death-reason"].(string); ok {
+		m.Reason = reason
+	}
+	json.Unmarshal(d.Body, &m.Payload)
+	return m
+}
+
+// Filter selects dead-lettered messages. The zero Filter matches every
+// message.
+type Filter struct {
+	// Fields must all equal the payload's top-level fields of the same name,
+	// compared as text (e.g. "token" => "abc", "chatNumber" => "3")
+	Fields map[string]string
+	// MinRetries skips messages that were retried fewer times
+	MinRetries int
+}
+
+// ParseField parses a "field=value" filter.
+func (f *Filter) ParseField(expr string) error {
+	field, value, ok := strings.Cut(expr, "=")
+	if !ok || field == "" {
+		return fmt.Errorf("invalid filter %q, expected field=value", expr)
+	}
+	if f.Fields == nil {
+		f.Fields = make(map[string]string)
+	}
+	f.Fields[field] = value
+	return nil
+}
+
+func (f Filter) Match(m Message) bool {
+	if m.RetryCount < f.MinRetries {
+		return false
+	}
+	for field, expected := range f.Fields {
+		value, ok := m.Payload[field]
+		if !ok || fmt.Sprint(value) != expected {
+			return false
+		}
+	}
+	return true
+}
+
+// Options describe one pass over a queue's DLQ.
+type Options struct {
+	// Queue is the original queue, e.g. "create_chats"
+	Queue  string
+	Filter Filter
+	// Limit stops after this many matching messages; 0 means no limit
+	Limit  int
+	Action Action
+	// DryRun reports what Replay or Purge would do without doing it
+	DryRun bool
+}
+
+// Result counts what Run did.
+type Result struct {
+	Scanned  int
+	Matched  int
+	Replayed int
+	Purged   int
+}
+
+// Stats is the depth of one DLQ.
+type Stats struct {
+	Queue    string
+	Messages int
+}
+
+// Inspector reads, replays and purges the dead letter queues created by
+// RabbitMQ.DeclareQueueWithDLQ.
+type Inspector struct {
+	rabbit    *queue.RabbitMQ
+	publisher *queue.Publisher
+}
+
+func NewInspector(rabbit *queue.RabbitMQ) *Inspector {
+	return &Inspector{
+		rabbit:    rabbit,
+		publisher: queue.NewPublisher(rabbit),
+	}
+}
+
+// List returns the depth of the DLQ of every queue in queues. DLQs that
+// don't exist yet are skipped; any other error is returned.
+func (i *Inspector) List(queues []string) ([]Stats, error) {
+	var stats []Stats
+	for _, name := range queues {
+		// A failed passive declare closes the channel, so each gets its own
+		ch, err := i.rabbit.CreateChannel()
+		if err != nil {
+			return nil, err
+		}
+		q, err := ch.QueueDeclarePassive(name+Suffix, true, false, false, false, nil)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect %s: %w", name+Suffix, err)
+		}
+		ch.Close()
+		stats = append(stats, Stats{Queue: name, Messages: q.Messages})
+	}
+	return stats, nil
+}
+
+// isNotFound reports whether err is the broker's 404 for a queue that
+// doesn't exist.
+func isNotFound(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound
+}
+
+// Run scans the messages that were in the DLQ of opts.Queue when it started
+// and calls visit for every match before acting on it. Messages Run doesn't
+// remove are handed back to the DLQ when it returns. A replayed message is
+// only removed from the DLQ once the broker confirmed its republish.
+func (i *Inspector) Run(ctx context.Context, opts Options, visit func(Message)) (Result, error) {
+	var result Result
+	dlqName := opts.Queue + Suffix
+
+	ch, err := i.rabbit.CreateChannel()
+	if err != nil {
+		return result, err
+	}
+	// Closing the channel requeues every message still unacknowledged
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(dlqName, true, false, false, false, nil)
+	if err != nil {
+		return result, fmt.Errorf("failed to inspect %s: %w", dlqName, err)
+	}
+
+	// Only the messages present now: replayed messages that fail again would
+	// otherwise come back into the scan
+	for result.Scanned < q.Messages {
+		if opts.Limit > 0 && result.Matched >= opts.Limit {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		d, ok, err := ch.Get(dlqName, false)
+		if err != nil {
+			return result, fmt.Errorf("failed to read from %s: %w", dlqName, err)
+		}
+		if !ok {
+			break
+		}
+		result.Scanned++
+
+		m := newMessage(result.Scanned, d)
+		if !opts.Filter.Match(m) {
+			continue
+		}
+		result.Matched++
+		visit(m)
+
+		if opts.DryRun {
+			continue
+		}
+		switch opts.Action {
+		case Replay:
+			if err := i.publisher.PublishRaw(ctx, opts.Queue, replayPublishing(d)); err != nil {
+				return result, fmt.Errorf("failed to replay message %d: %w", m.Index, err)
+			}
+			if err := d.Ack(false); err != nil {
+				return result, err
+			}
+			result.Replayed++
+		case Purge:
+			if err := d.Ack(false); err != nil {
+				return result, err
+			}
+			result.Purged++
+		}
+	}
+
+	return result, nil
+}
+
+// replayPublishing copies d with the retry and dead-letter headers removed,
+// so the replayed message gets a full set of retries again.
+func replayPublishing(d amqp.Delivery) amqp.Publishing {
+	headers := make(amqp.Table, len(d.Headers))
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	delete(headers, queue.RetryCountHeader)
+	delete(headers, queue.FirstFailureHeader)
+	delete(headers, queue.OriginalQueueHeader)
+	delete(headers, queue.FailureClassHeader)
+	delete(headers, queue.FailureReasonHeader)
+	delete(headers, queue.LastErrorHeader)
+	for _, h := range deathHeaders {
+		delete(headers, h)
+	}
+
+	return amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  d.ContentType,
+		Headers:      headers,
+		Body:         d.Body,
+	}
+}
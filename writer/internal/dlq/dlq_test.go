@@ -0,0 +1,134 @@
+package dlq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chat/writer/internal/queue"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func deadLettered() amqp.Delivery {
+	return amqp.Delivery{
+		ContentType: "application/json",
+		Headers: amqp.Table{
+			queue.RetryCountHeader:    int32(5),
+			queue.FirstFailureHeader:  int64(1731578400),
+			queue.OriginalQueueHeader: "create_chats",
+			"x-death":                 []interface{}{amqp.Table{"reason": "rejected"}},
+			"x-first-death-reason":    "rejected",
+			"x-first-death-queue":     "create_chats",
+			"traceparent":             "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		},
+		Body: []byte(`{"token":"abc","chatNumber":3,"creatorId":1}`),
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	m := newMessage(2, deadLettered())
+
+	if m.Index != 2 || m.RetryCount != 5 || m.Reason != "rejected" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if !m.FirstFailure.Equal(time.Unix(1731578400, 0)) {
+		t.Errorf("FirstFailure = %v", m.FirstFailure)
+	}
+	if m.Payload["token"] != "abc" {
+		t.Errorf("expected decoded payload, got %v", m.Payload)
+	}
+
+	d := deadLettered()
+	d.Headers[queue.FailureClassHeader] = "permanent"
+	d.Headers[queue.FailureReasonHeader] = "message_not_found"
+	if classified := newMessage(1, d); classified.Reason != "permanent: message_not_found" {
+		t.Errorf("expected the writer's classification as reason, got %q", classified.Reason)
+	}
+
+	raw := newMessage(1, amqp.Delivery{Body: []byte("not json")})
+	if raw.Payload != nil || raw.RetryCount != 0 || !raw.FirstFailure.IsZero() {
+		t.Errorf("expected undecoded message without retries, got %+v", raw)
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	m := newMessage(1, deadLettered())
+
+	tests := []struct {
+		name     string
+		fields   []string
+		retries  int
+		expected bool
+	}{
+		{"zero filter", nil, 0, true},
+		{"string field", []string{"token=abc"}, 0, true},
+		{"number field", []string{"token=abc", "chatNumber=3"}, 0, true},
+		{"different value", []string{"chatNumber=4"}, 0, false},
+		{"missing field", []string{"messageNumber=1"}, 0, false},
+		{"enough retries", nil, 5, true},
+		{"too few retries", nil, 6, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := Filter{MinRetries: tt.retries}
+			for _, expr := range tt.fields {
+				if err := filter.ParseField(expr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := filter.Match(m); got != tt.expected {
+				t.Errorf("Match() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFilter_ParseFieldRejectsInvalid(t *testing.T) {
+	var filter Filter
+	for _, expr := range []string{"token", "=abc"} {
+		if err := filter.ParseField(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestReplayPublishing_ResetsRetryHeaders(t *testing.T) {
+	d := deadLettered()
+	queue.SetFailureHeaders(d.Headers, errors.New("boom"))
+	publishing := replayPublishing(d)
+
+	for _, header := range []string{queue.RetryCountHeader, queue.FirstFailureHeader, queue.OriginalQueueHeader,
+		queue.FailureClassHeader, queue.FailureReasonHeader, queue.LastErrorHeader, "x-death", "x-first-death-reason", "x-first-death-queue"} {
+		if _, ok := publishing.Headers[header]; ok {
+			t.Errorf("expected %s to be removed", header)
+		}
+	}
+	if publishing.Headers["traceparent"] != d.Headers["traceparent"] {
+		t.Error("expected other headers to be kept")
+	}
+	if _, ok := d.Headers[queue.RetryCountHeader]; !ok {
+		t.Error("expected the delivery's own headers to be left alone")
+	}
+	if string(publishing.Body) != string(d.Body) || publishing.DeliveryMode != amqp.Persistent {
+		t.Errorf("unexpected publishing %+v", publishing)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	notFound := &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue 'create_chats.dlq'"}
+	if !isNotFound(notFound) || !isNotFound(fmt.Errorf("declare: %w", notFound)) {
+		t.Error("expected a 404 to be recognised")
+	}
+	for _, err := range []error{
+		nil,
+		amqp.ErrClosed,
+		&amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED"},
+		errors.New("connection reset"),
+	} {
+		if isNotFound(err) {
+			t.Errorf("expected %v not to be a 404", err)
+		}
+	}
+}
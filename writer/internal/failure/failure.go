@@ -0,0 +1,120 @@
+package failure
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Kind tells the retry handler how to route a failed delivery.
+type Kind int
+
+const (
+	// Transient failures may succeed on a later attempt and are retried with
+	// exponential backoff. Errors nobody classified are transient.
+	Transient Kind = iota
+	// Permanent failures can never succeed and go straight to the DLQ.
+	Permanent
+	// Throttled failures mean a dependency asked us to slow down; they are
+	// retried with a longer backoff.
+	Throttled
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Permanent:
+		return "permanent"
+	case Throttled:
+		return "throttled"
+	default:
+		return "transient"
+	}
+}
+
+// Error marks err with its Kind and a short machine-readable reason such as
+// "message_not_found".
+type Error struct {
+	Kind   Kind
+	Reason string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(kind Kind, reason string, err error) error {
+	if err == nil {
+		err = errors.New(reason)
+	}
+	return &Error{Kind: kind, Reason: reason, Err: err}
+}
+
+// NewPermanent marks err as a failure that can never succeed.
+func NewPermanent(reason string, err error) error {
+	return newError(Permanent, reason, err)
+}
+
+// NewTransient marks err as a failure worth retrying.
+func NewTransient(reason string, err error) error {
+	return newError(Transient, reason, err)
+}
+
+// NewThrottled marks err as a failure caused by a dependency shedding load.
+func NewThrottled(reason string, err error) error {
+	return newError(Throttled, reason, err)
+}
+
+// mysqlErrors classifies MySQL server errors by number. Constraint and data
+// errors fail the same way on every attempt; lock conflicts resolve
+// themselves; a full connection table means the server is overloaded.
+var mysqlErrors = map[uint16]struct {
+	kind   Kind
+	reason string
+}{
+	1048: {Permanent, "null_violation"},
+	1062: {Permanent, "duplicate_key"},
+	1264: {Permanent, "out_of_range"},
+	1366: {Permanent, "incorrect_value"},
+	1406: {Permanent, "data_too_long"},
+	1451: {Permanent, "foreign_key_violation"},
+	1452: {Permanent, "foreign_key_violation"},
+	3819: {Permanent, "check_constraint_violation"},
+	1205: {Transient, "lock_wait_timeout"},
+	1213: {Transient, "deadlock"},
+	1040: {Throttled, "too_many_connections"},
+	1203: {Throttled, "too_many_connections"},
+}
+
+// Classify returns the kind of err and the reason recorded with it. Errors
+// marked with an Error anywhere in their chain keep that classification;
+// MySQL errors are classified by number; anything else is transient.
+func Classify(err error) (Kind, string) {
+	var marked *Error
+	if errors.As(err, &marked) {
+		return marked.Kind, marked.Reason
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		if c, ok := mysqlErrors[mysqlErr.Number]; ok {
+			return c.kind, c.reason
+		}
+		return Transient, fmt.Sprintf("mysql_%d", mysqlErr.Number)
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return Transient, "timeout"
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		return Transient, "bad_connection"
+	}
+	return Transient, "unclassified"
+}
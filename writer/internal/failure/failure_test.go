@@ -0,0 +1,51 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		kind   Kind
+		reason string
+	}{
+		{"marked permanent", NewPermanent("message_not_found", errors.New("message not found")), Permanent, "message_not_found"},
+		{"marked throttled", NewThrottled("elasticsearch_rejected", nil), Throttled, "elasticsearch_rejected"},
+		{"marked and wrapped", fmt.Errorf("update: %w", NewPermanent("gone", nil)), Permanent, "gone"},
+		{"data too long", &mysql.MySQLError{Number: 1406, Message: "Data too long for column 'body'"}, Permanent, "data_too_long"},
+		{"wrapped foreign key", fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1452}), Permanent, "foreign_key_violation"},
+		{"deadlock", &mysql.MySQLError{Number: 1213}, Transient, "deadlock"},
+		{"too many connections", &mysql.MySQLError{Number: 1040}, Throttled, "too_many_connections"},
+		{"other mysql error", &mysql.MySQLError{Number: 1146}, Transient, "mysql_1146"},
+		{"timeout", fmt.Errorf("query: %w", context.DeadlineExceeded), Transient, "timeout"},
+		{"unknown", errors.New("boom"), Transient, "unclassified"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, reason := Classify(tt.err)
+			if kind != tt.kind || reason != tt.reason {
+				t.Errorf("Classify() = %s %s, want %s %s", kind, reason, tt.kind, tt.reason)
+			}
+		})
+	}
+}
+
+func TestError_KeepsCause(t *testing.T) {
+	cause := errors.New("message not found")
+	err := NewPermanent("message_not_found", cause)
+
+	if err.Error() != cause.Error() || !errors.Is(err, cause) {
+		t.Errorf("expected %v to wrap %v", err, cause)
+	}
+	if NewTransient("retry_me", nil).Error() != "retry_me" {
+		t.Error("expected the reason as message when there is no cause")
+	}
+}
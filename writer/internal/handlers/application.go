@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/logging"
+	"github.com/chat/writer/internal/models"
+	"github.com/chat/writer/internal/services"
+)
+
+type ApplicationHandler struct {
+	db          *database.DB
+	esService   *services.ElasticsearchService
+	redisClient *database.RedisClient
+}
+
+func NewApplicationHandler(db *database.DB, esService *services.ElasticsearchService, redisClient *database.RedisClient) *ApplicationHandler {
+	return &ApplicationHandler{
+		db:          db,
+		esService:   esService,
+		redisClient: redisClient,
+	}
+}
+
+// DeleteApplication removes an application with all of its chats and
+// messages. Rows are deleted in chunks (message revisions, messages, chats,
+// then the application), followed by the search documents and every
+// chat_counter and message_counter key of the application. Every step is
+// idempotent, so a failed delivery can simply be retried from the start.
+func (h *ApplicationHandler) DeleteApplication(ctx context.Context, msg models.DeleteApplicationMessage) error {
+	if _, err := deleteInChunks(ctx, h.db, `
+		DELETE FROM message_revisions
+		WHERE token = ?
+	`, msg.Token); err != nil {
+		return fmt.Errorf("failed to delete message revisions: %w", err)
+	}
+
+	messages, err := deleteInChunks(ctx, h.db, `
+		DELETE FROM messages
+		WHERE token = ?
+	`, msg.Token)
+	if err != nil {
+		return fmt.Errorf("failed to delete messages: %w", err)
+	}
+
+	chats, err := deleteInChunks(ctx, h.db, `
+		DELETE FROM chats
+		WHERE token = ?
+	`, msg.Token)
+	if err != nil {
+		return fmt.Errorf("failed to delete chats: %w", err)
+	}
+
+	if _, err := h.db.ExecContext(ctx, `
+		DELETE FROM applications
+		WHERE token = ?
+	`, msg.Token); err != nil {
+		return fmt.Errorf("failed to delete application: %w", err)
+	}
+
+	if h.esService != nil {
+		if err := h.esService.DeleteApplicationMessages(ctx, msg.Token); err != nil {
+			return fmt.Errorf("failed to delete application from search index: %w", err)
+		}
+	}
+
+	if h.redisClient != nil {
+		if err := h.deleteCounters(ctx, msg.Token); err != nil {
+			return err
+		}
+	}
+
+	logging.FromContext(ctx).Info("Deleted application", "chats", chats, "messages", messages)
+	return nil
+}
+
+func (h *ApplicationHandler) deleteCounters(ctx context.Context, token string) error {
+	messageCounters, err := h.redisClient.WithContext(ctx).ScanKeys(fmt.Sprintf("message_counter:%s:*", token))
+	if err != nil {
+		return fmt.Errorf("failed to scan message counters: %w", err)
+	}
+
+	keys := append(messageCounters, "chat_counter:"+token)
+	if err := h.redisClient.WithContext(ctx).Del(keys...); err != nil {
+		return fmt.Errorf("failed to delete counters: %w", err)
+	}
+
+	if err := h.redisClient.WithContext(ctx).SRem("chat_changes", token); err != nil {
+		logging.FromContext(ctx).Warn("Failed to remove token from chat_changes set", "token", token, "error", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/models"
+)
+
+func TestDeleteApplication_DeletesMessagesThenChatsThenApplication(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	h := NewApplicationHandler(&database.DB{DB: db}, nil, nil)
+
+	mock.ExpectExec(`DELETE FROM message_revisions\s+WHERE token = \?\s+LIMIT 1000`).
+		WithArgs("abc").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(`DELETE FROM messages\s+WHERE token = \?\s+LIMIT 1000`).
+		WithArgs("abc").
+		WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec(`DELETE FROM chats\s+WHERE token = \?\s+LIMIT 1000`).
+		WithArgs("abc").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM applications\s+WHERE token = \?`).
+		WithArgs("abc").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = h.DeleteApplication(context.Background(), models.DeleteApplicationMessage{Token: "abc"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/progress"
+)
+
+// DeleteChunkSize bounds how many rows a single cascade DELETE removes, so
+// deleting a large chat or application never holds long row locks.
+const DeleteChunkSize = 1000
+
+// deleteInChunks runs query (a DELETE without LIMIT) repeatedly with
+// LIMIT DeleteChunkSize until no rows are left, returning the total removed.
+// Every chunk reports progress, so a long cascade isn't taken for a stall.
+func deleteInChunks(ctx context.Context, db *database.DB, query string, args ...interface{}) (int64, error) {
+	var total int64
+	limited := fmt.Sprintf("%s LIMIT %d", query, DeleteChunkSize)
+
+	for {
+		result, err := db.ExecContext(ctx, limited, args...)
+		if err != nil {
+			return total, err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += rows
+		progress.Touch(ctx)
+
+		if rows < DeleteChunkSize {
+			return total, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+	}
+}
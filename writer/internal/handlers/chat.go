@@ -1,42 +1,97 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/logging"
 	"github.com/chat/writer/internal/models"
+	"github.com/chat/writer/internal/services"
 )
 
 type ChatHandler struct {
 	db          *database.DB
+	esService   *services.ElasticsearchService
 	redisClient *database.RedisClient
 }
 
-func NewChatHandler(db *database.DB, redisClient *database.RedisClient) *ChatHandler {
+func NewChatHandler(db *database.DB, esService *services.ElasticsearchService, redisClient *database.RedisClient) *ChatHandler {
 	return &ChatHandler{
 		db:          db,
+		esService:   esService,
 		redisClient: redisClient,
 	}
 }
 
-func (h *ChatHandler) CreateChat(msg models.CreateChatMessage) error {
+func (h *ChatHandler) CreateChat(ctx context.Context, msg models.CreateChatMessage) error {
 	// Insert chat directly using token (no need to lookup application_id)
-	_, err := h.db.Exec(`
+	_, err := h.db.ExecContext(ctx, `
 		INSERT INTO chats (token, number, creator_id, created_at, updated_at)
 		VALUES (?, ?, ?, NOW(), NOW())
 	`, msg.Token, msg.ChatNumber, msg.CreatorID)
 
-	if err != nil {
+	if database.IsDuplicateKey(err) {
+		// Redelivery of a chat we already inserted - still make sure the count syncs
+		logging.FromContext(ctx).Info("Chat already exists, treating as applied")
+	} else if err != nil {
 		return err
 	}
 
 	// Add token to Redis set for tracking changes
 	if h.redisClient != nil {
-		if err := h.redisClient.SAdd("chat_changes", msg.Token); err != nil {
+		if err := h.redisClient.WithContext(ctx).SAdd("chat_changes", msg.Token); err != nil {
 			// Log but don't fail the operation
-			fmt.Printf("Warning: Failed to add to chat_changes set: %v\n", err)
+			logging.FromContext(ctx).Warn("Failed to add to chat_changes set", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteChat removes a chat and all of its messages. Message revisions and
+// messages are deleted in chunks first, then the chat row, then the search
+// documents and the chat's Redis counter. Every step is idempotent, so a
+// failed delivery can simply be retried from the start.
+func (h *ChatHandler) DeleteChat(ctx context.Context, msg models.DeleteChatMessage) error {
+	if _, err := deleteInChunks(ctx, h.db, `
+		DELETE FROM message_revisions
+		WHERE token = ? AND chat_number = ?
+	`, msg.Token, msg.ChatNumber); err != nil {
+		return fmt.Errorf("failed to delete message revisions: %w", err)
+	}
+
+	deleted, err := deleteInChunks(ctx, h.db, `
+		DELETE FROM messages
+		WHERE token = ? AND chat_number = ?
+	`, msg.Token, msg.ChatNumber)
+	if err != nil {
+		return fmt.Errorf("failed to delete messages: %w", err)
+	}
+
+	if _, err := h.db.ExecContext(ctx, `
+		DELETE FROM chats
+		WHERE token = ? AND number = ?
+	`, msg.Token, msg.ChatNumber); err != nil {
+		return fmt.Errorf("failed to delete chat: %w", err)
+	}
+
+	if h.esService != nil {
+		if err := h.esService.DeleteChatMessages(ctx, msg.Token, msg.ChatNumber); err != nil {
+			return fmt.Errorf("failed to delete chat from search index: %w", err)
+		}
+	}
+
+	if h.redisClient != nil {
+		chatKey := fmt.Sprintf("%s:%d", msg.Token, msg.ChatNumber)
+		if err := h.redisClient.WithContext(ctx).Del("message_counter:" + chatKey); err != nil {
+			return fmt.Errorf("failed to delete message counter: %w", err)
+		}
+		if err := h.redisClient.WithContext(ctx).SRem("message_changes", chatKey); err != nil {
+			logging.FromContext(ctx).Warn("Failed to remove chat from message_changes set", "error", err)
 		}
 	}
 
+	logging.FromContext(ctx).Info("Deleted chat", "messages", deleted)
 	return nil
 }
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/models"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestCreateChat_DuplicateKeyIsTreatedAsApplied(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	h := NewChatHandler(&database.DB{DB: db}, nil, nil)
+
+	mock.ExpectExec(`INSERT INTO chats`).
+		WithArgs("abc", 1, 7).
+		WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'abc-1' for key 'index_chats_on_token_and_number'"})
+
+	err = h.CreateChat(context.Background(), models.CreateChatMessage{Token: "abc", ChatNumber: 1, CreatorID: 7})
+	if err != nil {
+		t.Errorf("Expected redelivered chat to succeed, got: %v", err)
+	}
+}
+
+func TestCreateChat_OtherErrorsFail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	h := NewChatHandler(&database.DB{DB: db}, nil, nil)
+
+	mock.ExpectExec(`INSERT INTO chats`).WillReturnError(errors.New("connection refused"))
+
+	err = h.CreateChat(context.Background(), models.CreateChatMessage{Token: "abc", ChatNumber: 1, CreatorID: 7})
+	if err == nil {
+		t.Error("Expected error to be returned")
+	}
+}
+
+func TestDeleteChat_DeletesMessagesInChunks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	h := NewChatHandler(&database.DB{DB: db}, nil, nil)
+
+	mock.ExpectExec(`DELETE FROM message_revisions\s+WHERE token = \? AND chat_number = \?\s+LIMIT 1000`).
+		WithArgs("abc", 1).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+	mock.ExpectExec(`DELETE FROM messages\s+WHERE token = \? AND chat_number = \?\s+LIMIT 1000`).
+		WithArgs("abc", 1).
+		WillReturnResult(sqlmock.NewResult(0, DeleteChunkSize))
+	mock.ExpectExec(`DELETE FROM messages\s+WHERE token = \? AND chat_number = \?\s+LIMIT 1000`).
+		WithArgs("abc", 1).
+		WillReturnResult(sqlmock.NewResult(0, 42))
+	mock.ExpectExec(`DELETE FROM chats\s+WHERE token = \? AND number = \?`).
+		WithArgs("abc", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = h.DeleteChat(context.Background(), models.DeleteChatMessage{Token: "abc", ChatNumber: 1})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
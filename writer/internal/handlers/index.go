@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/models"
+	"github.com/chat/writer/internal/services"
+)
+
+// IndexQueue is the queue MessageHandler publishes search indexing jobs to.
+const IndexQueue = "index_messages"
+
+// Publisher enqueues follow-up work for another consumer.
+type Publisher interface {
+	Publish(ctx context.Context, queueName string, payload any) error
+}
+
+// IndexHandler keeps the Elasticsearch messages index in line with MySQL.
+// Jobs only carry the message key; the document is always rebuilt from the
+// current row, so replaying or reordering jobs can't make search diverge.
+type IndexHandler struct {
+	db        *database.DB
+	esService *services.ElasticsearchService
+	// slots caps the documents being submitted at once across batches
+	slots chan struct{}
+}
+
+func NewIndexHandler(db *database.DB, esService *services.ElasticsearchService, concurrency int) *IndexHandler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &IndexHandler{
+		db:        db,
+		esService: esService,
+		slots:     make(chan struct{}, concurrency),
+	}
+}
+
+type messageKey struct {
+	token      string
+	chatNumber int
+	number     int
+}
+
+// SyncMessages loads the rows for msgs in one query and indexes them, or
+// deletes their documents when the row no longer exists or is soft-deleted.
+// The returned slice has one error per message.
+func (h *IndexHandler) SyncMessages(ctx context.Context, msgs []models.IndexMessageMessage) []error {
+	errs := make([]error, len(msgs))
+	if len(msgs) == 0 {
+		return errs
+	}
+
+	docs, err := h.loadDocuments(ctx, msgs)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	// Items are submitted concurrently so they share bulk requests, but no
+	// more than the handler's slots allow across all batches
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		h.slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, msg models.IndexMessageMessage) {
+			defer func() {
+				<-h.slots
+				wg.Done()
+			}()
+			doc, ok := docs[messageKey{msg.Token, msg.ChatNumber, msg.MessageNumber}]
+			if !ok {
+				errs[i] = h.esService.DeleteMessage(ctx, msg.Token, msg.ChatNumber, msg.MessageNumber)
+				return
+			}
+			errs[i] = h.esService.IndexMessage(ctx, doc)
+		}(i, msg)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func (h *IndexHandler) loadDocuments(ctx context.Context, msgs []models.IndexMessageMessage) (map[messageKey]services.MessageDocument, error) {
+	conditions := make([]string, len(msgs))
+	args := make([]interface{}, 0, len(msgs)*3)
+	for i, msg := range msgs {
+		conditions[i] = "(m.token = ? AND m.chat_number = ? AND m.number = ?)"
+		args = append(args, msg.Token, msg.ChatNumber, msg.MessageNumber)
+	}
+
+	rows, err := h.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT m.id, m.token, m.chat_number, m.number, m.body, m.edit_count, m.version, m.creator_id, m.created_at, u.name
+		FROM messages m
+		LEFT JOIN users u ON u.id = m.creator_id
+		WHERE m.deleted_at IS NULL AND (%s)
+	`, strings.Join(conditions, " OR ")), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load messages for indexing: %w", err)
+	}
+	defer rows.Close()
+
+	docs := make(map[messageKey]services.MessageDocument, len(msgs))
+	for rows.Next() {
+		var doc services.MessageDocument
+		var senderID sql.NullInt64
+		var senderName sql.NullString
+		var createdAt time.Time
+		if err := rows.Scan(&doc.ID, &doc.Token, &doc.ChatNumber, &doc.Number, &doc.Body, &doc.EditCount, &doc.Version, &senderID, &createdAt, &senderName); err != nil {
+			return nil, err
+		}
+		doc.SenderID = int(senderID.Int64)
+		doc.SenderName = senderName.String
+		doc.Edited = doc.EditCount > 0
+		doc.CreatedAt = createdAt.Format(time.RFC3339)
+		docs[messageKey{doc.Token, doc.ChatNumber, doc.Number}] = doc
+	}
+
+	return docs, rows.Err()
+}
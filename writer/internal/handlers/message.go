@@ -1,117 +1,281 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
 	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/failure"
+	"github.com/chat/writer/internal/logging"
 	"github.com/chat/writer/internal/models"
-	"github.com/chat/writer/internal/services"
 )
 
 type MessageHandler struct {
 	db          *database.DB
-	esService   *services.ElasticsearchService
+	indexQueue  Publisher
 	redisClient *database.RedisClient
 }
 
-func NewMessageHandler(db *database.DB, esService *services.ElasticsearchService, redisClient *database.RedisClient) *MessageHandler {
+// NewMessageHandler creates a MessageHandler. indexQueue receives a search
+// indexing job for every written message; pass nil when search is disabled.
+func NewMessageHandler(db *database.DB, indexQueue Publisher, redisClient *database.RedisClient) *MessageHandler {
 	return &MessageHandler{
 		db:          db,
-		esService:   esService,
+		indexQueue:  indexQueue,
 		redisClient: redisClient,
 	}
 }
 
-func (h *MessageHandler) CreateMessage(msg models.CreateMessageMessage) error {
-	// Parse date
-	createdAt, err := time.Parse(time.RFC3339, msg.Date)
-	if err != nil {
-		createdAt = time.Now()
-	}
+func (h *MessageHandler) CreateMessage(ctx context.Context, msg models.CreateMessageMessage) error {
+	createdAt := parseMessageDate(msg.Date)
 
 	// Insert message directly using token and chat_number (no need to lookup chat_id)
-	result, err := h.db.Exec(`
+	_, err := h.db.ExecContext(ctx, `
 		INSERT INTO messages (token, chat_number, number, body, creator_id, created_at, updated_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`, msg.Token, msg.ChatNumber, msg.MessageNumber, msg.Body, msg.SenderID, createdAt, createdAt)
 
+	if database.IsDuplicateKey(err) {
+		// Redelivery after a crash between INSERT and Ack - the row is
+		// already there, but the side effects below may not have happened
+		logging.FromContext(ctx).Info("Message already exists, treating as applied")
+	} else if err != nil {
+		return err
+	}
+
+	h.trackMessageChanges(ctx, msg)
+
+	return h.enqueueIndex(ctx, msg.Token, msg.ChatNumber, msg.MessageNumber)
+}
+
+// CreateMessages inserts msgs with a single multi-row INSERT inside a
+// transaction. If the batch fails, every message is retried on its own so one
+// bad row (or one already inserted by an earlier delivery) only affects its
+// own delivery. The returned slice has one error per message.
+func (h *MessageHandler) CreateMessages(ctx context.Context, msgs []models.CreateMessageMessage) []error {
+	errs := make([]error, len(msgs))
+	if len(msgs) == 0 {
+		return errs
+	}
+	if len(msgs) == 1 {
+		errs[0] = h.CreateMessage(logging.With(ctx, msgs[0].LogAttrs()...), msgs[0])
+		return errs
+	}
+
+	if err := h.insertMessages(ctx, msgs); err != nil {
+		logging.FromContext(ctx).Warn("Batch insert failed, falling back to per-row inserts", "messages", len(msgs), "error", err)
+		for i, msg := range msgs {
+			// The batch's logger doesn't identify single messages
+			errs[i] = h.CreateMessage(logging.With(ctx, msg.LogAttrs()...), msg)
+		}
+		return errs
+	}
+
+	h.trackMessageChanges(ctx, msgs...)
+
+	for i, msg := range msgs {
+		errs[i] = h.enqueueIndex(ctx, msg.Token, msg.ChatNumber, msg.MessageNumber)
+	}
+
+	return errs
+}
+
+func (h *MessageHandler) insertMessages(ctx context.Context, msgs []models.CreateMessageMessage) error {
+	placeholders := make([]string, len(msgs))
+	args := make([]interface{}, 0, len(msgs)*7)
+
+	for i, msg := range msgs {
+		createdAt := parseMessageDate(msg.Date)
+		placeholders[i] = "(?, ?, ?, ?, ?, ?, ?)"
+		args = append(args, msg.Token, msg.ChatNumber, msg.MessageNumber, msg.Body, msg.SenderID, createdAt, createdAt)
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// Get the inserted message ID
-	messageID, err := result.LastInsertId()
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO messages (token, chat_number, number, body, creator_id, created_at, updated_at)
+		VALUES %s
+	`, strings.Join(placeholders, ", ")), args...)
 	if err != nil {
-		log.Printf("Warning: Failed to get message ID: %v", err)
-	}
-
-	// Index in Elasticsearch asynchronously (non-blocking)
-	if h.esService != nil {
-		go func() {
-			// Get sender name for Elasticsearch
-			var senderName string
-			err := h.db.QueryRow("SELECT name FROM users WHERE id = ?", msg.SenderID).Scan(&senderName)
-			if err != nil {
-				log.Printf("Warning: Failed to get sender name: %v", err)
-				senderName = ""
-			}
+		return err
+	}
 
-			doc := services.MessageDocument{
-				ID:         int(messageID),
-				Token:      msg.Token,
-				ChatNumber: msg.ChatNumber,
-				Number:     msg.MessageNumber,
-				Body:       msg.Body,
-				SenderID:   msg.SenderID,
-				SenderName: senderName,
-				CreatedAt:  createdAt.Format(time.RFC3339),
-			}
+	return tx.Commit()
+}
 
-			if err := h.esService.IndexMessage(doc); err != nil {
-				log.Printf("Warning: Failed to index message in Elasticsearch: %v", err)
-			}
-		}()
+func parseMessageDate(date string) time.Time {
+	createdAt, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return time.Now()
 	}
+	return createdAt
+}
 
-	// Add token:chatNumber to Redis set for tracking changes
-	if h.redisClient != nil {
-		key := fmt.Sprintf("%s:%d", msg.Token, msg.ChatNumber)
-		if err := h.redisClient.SAdd("message_changes", key); err != nil {
-			// Log but don't fail the operation
-			log.Printf("Warning: Failed to add to message_changes set: %v", err)
-		}
+// enqueueIndex publishes a durable indexing job for the message. Failing to
+// publish fails the delivery, so the job is never silently lost.
+func (h *MessageHandler) enqueueIndex(ctx context.Context, token string, chatNumber int, messageNumber int) error {
+	if h.indexQueue == nil {
+		return nil
 	}
 
+	err := h.indexQueue.Publish(ctx, IndexQueue, models.IndexMessageMessage{
+		Token:         token,
+		ChatNumber:    chatNumber,
+		MessageNumber: messageNumber,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue search indexing: %w", err)
+	}
 	return nil
 }
 
-func (h *MessageHandler) UpdateMessage(msg models.UpdateMessageMessage) error {
-	// Update message directly using token, chat_number, and number
-	result, err := h.db.Exec(`
-		UPDATE messages
-		SET body = ?, updated_at = NOW()
-		WHERE token = ? AND chat_number = ? AND number = ?
-	`, msg.Body, msg.Token, msg.ChatNumber, msg.MessageNumber)
+// trackMessageChanges adds token:chatNumber to the Redis set read by CountSync
+func (h *MessageHandler) trackMessageChanges(ctx context.Context, msgs ...models.CreateMessageMessage) {
+	if h.redisClient == nil {
+		return
+	}
 
+	keys := make([]any, len(msgs))
+	for i, msg := range msgs {
+		keys[i] = fmt.Sprintf("%s:%d", msg.Token, msg.ChatNumber)
+	}
+	if err := h.redisClient.WithContext(ctx).SAdd("message_changes", keys...); err != nil {
+		// Log but don't fail the operation
+		logging.FromContext(ctx).Warn("Failed to add to message_changes set", "chats", len(keys), "error", err)
+	}
+}
+
+// UpdateMessage replaces the body of a message and appends the previous body
+// to message_revisions in the same transaction, so no edit is ever lost. The
+// row is locked while the revision number is derived from edit_count.
+//
+// Updates can arrive out of order (a retried delivery comes back through a
+// delay queue after newer ones), so a versioned update that is not newer than
+// the stored version is dropped as stale. An update whose body matches the
+// current one (e.g. a redelivery after the commit but before the Ack) is
+// applied without a new revision, only raising the stored version.
+func (h *MessageHandler) UpdateMessage(ctx context.Context, msg models.UpdateMessageMessage) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	var editCount int
+	var version int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT body, edit_count, version
+		FROM messages
+		WHERE token = ? AND chat_number = ? AND number = ? AND deleted_at IS NULL
+		FOR UPDATE
+	`, msg.Token, msg.ChatNumber, msg.MessageNumber).Scan(&previous, &editCount, &version)
+	if err == sql.ErrNoRows {
+		// Retrying can't bring back a message that doesn't exist
+		return failure.NewPermanent("message_not_found", fmt.Errorf("message not found"))
+	}
 	if err != nil {
 		return err
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return fmt.Errorf("message not found")
+	if msg.Version != 0 && msg.Version <= version {
+		logging.FromContext(ctx).Info("Skipping stale update",
+			"version", msg.Version, "stored_version", version)
+		return nil
 	}
 
-	// Update in Elasticsearch asynchronously (non-blocking)
-	if h.esService != nil {
-		go func() {
-			if err := h.esService.UpdateMessage(msg.Token, msg.ChatNumber, msg.MessageNumber, msg.Body); err != nil {
-				log.Printf("Warning: Failed to update message in Elasticsearch: %v", err)
+	if previous == msg.Body {
+		logging.FromContext(ctx).Info("Message already has this body, treating as applied")
+		if msg.Version > version {
+			// Still record the version, or an older update with another body
+			// would pass the stale check later
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE messages
+				SET version = GREATEST(version, ?)
+				WHERE token = ? AND chat_number = ? AND number = ?
+			`, msg.Version, msg.Token, msg.ChatNumber, msg.MessageNumber); err != nil {
+				return err
 			}
-		}()
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+		}
+		return h.enqueueIndex(ctx, msg.Token, msg.ChatNumber, msg.MessageNumber)
 	}
 
-	return nil
+	var editorID sql.NullInt64
+	if msg.EditorID > 0 {
+		editorID = sql.NullInt64{Int64: int64(msg.EditorID), Valid: true}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO message_revisions (token, chat_number, message_number, revision, body, editor_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW())
+	`, msg.Token, msg.ChatNumber, msg.MessageNumber, editCount+1, previous, editorID); err != nil {
+		return fmt.Errorf("failed to record revision: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE messages
+		SET body = ?, edit_count = edit_count + 1, version = GREATEST(version + 1, ?), updated_at = NOW()
+		WHERE token = ? AND chat_number = ? AND number = ?
+	`, msg.Body, msg.Version, msg.Token, msg.ChatNumber, msg.MessageNumber); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return h.enqueueIndex(ctx, msg.Token, msg.ChatNumber, msg.MessageNumber)
+}
+
+// DeleteMessage soft-deletes a message (sets deleted_at, keeping the row and
+// its revisions as a tombstone) or, for msg.Hard, removes the row together
+// with its revisions. Either way the search
+// document is removed through the index queue. Deleting a message that is
+// already gone is a no-op, so redeliveries succeed.
+//
+// Counters are deliberately left alone: message_counter in Redis hands out
+// message numbers and chats.messages_count mirrors it, so both keep counting
+// deleted messages. Decrementing them would hand out a deleted message's
+// number again.
+func (h *MessageHandler) DeleteMessage(ctx context.Context, msg models.DeleteMessageMessage) error {
+	query := `
+		UPDATE messages
+		SET deleted_at = NOW(), updated_at = NOW()
+		WHERE token = ? AND chat_number = ? AND number = ? AND deleted_at IS NULL
+	`
+	if msg.Hard {
+		// Revisions go first so a retry after a partial failure still finds them
+		if _, err := h.db.ExecContext(ctx, `
+		DELETE FROM message_revisions
+		WHERE token = ? AND chat_number = ? AND message_number = ?
+	`, msg.Token, msg.ChatNumber, msg.MessageNumber); err != nil {
+			return fmt.Errorf("failed to delete revisions: %w", err)
+		}
+
+		query = `
+		DELETE FROM messages
+		WHERE token = ? AND chat_number = ? AND number = ?
+	`
+	}
+
+	result, err := h.db.ExecContext(ctx, query, msg.Token, msg.ChatNumber, msg.MessageNumber)
+	if err != nil {
+		return err
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		logging.FromContext(ctx).Info("Message already deleted")
+	}
+
+	return h.enqueueIndex(ctx, msg.Token, msg.ChatNumber, msg.MessageNumber)
 }
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/failure"
+	"github.com/chat/writer/internal/models"
+	"github.com/go-sql-driver/mysql"
+)
+
+type fakePublisher struct {
+	published []any
+	err       error
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, queueName string, payload any) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.published = append(f.published, payload)
+	return nil
+}
+
+func newMockMessageHandler(t *testing.T) (*MessageHandler, sqlmock.Sqlmock, *fakePublisher) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	publisher := &fakePublisher{}
+	return NewMessageHandler(&database.DB{DB: db}, publisher, nil), mock, publisher
+}
+
+func batchOfMessages() []models.CreateMessageMessage {
+	return []models.CreateMessageMessage{
+		{Token: "abc", ChatNumber: 1, MessageNumber: 1, SenderID: 7, Body: "first", Date: "2024-01-01T00:00:00Z"},
+		{Token: "abc", ChatNumber: 1, MessageNumber: 2, SenderID: 7, Body: "second", Date: "2024-01-01T00:00:01Z"},
+		{Token: "xyz", ChatNumber: 3, MessageNumber: 1, SenderID: 8, Body: "third", Date: "2024-01-01T00:00:02Z"},
+	}
+}
+
+func TestCreateMessages_SingleMultiRowInsert(t *testing.T) {
+	h, mock, publisher := newMockMessageHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO messages \(token, chat_number, number, body, creator_id, created_at, updated_at\)\s+VALUES \(\?, \?, \?, \?, \?, \?, \?\), \(\?, \?, \?, \?, \?, \?, \?\), \(\?, \?, \?, \?, \?, \?, \?\)`).
+		WillReturnResult(sqlmock.NewResult(10, 3))
+	mock.ExpectCommit()
+
+	errs := h.CreateMessages(context.Background(), batchOfMessages())
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Expected no error for message %d, got: %v", i, err)
+		}
+	}
+	if len(publisher.published) != 3 {
+		t.Errorf("Expected an index job per message, got %d", len(publisher.published))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestCreateMessages_FallsBackToPerRowInserts(t *testing.T) {
+	h, mock, publisher := newMockMessageHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO messages`).WillReturnError(errors.New("data too long for column 'body'"))
+	mock.ExpectRollback()
+
+	mock.ExpectExec(`INSERT INTO messages`).WithArgs("abc", 1, 1, "first", 7, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(10, 1))
+	mock.ExpectExec(`INSERT INTO messages`).WithArgs("abc", 1, 2, "second", 7, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnError(errors.New("data too long for column 'body'"))
+	mock.ExpectExec(`INSERT INTO messages`).WithArgs("xyz", 3, 1, "third", 8, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(11, 1))
+
+	errs := h.CreateMessages(context.Background(), batchOfMessages())
+
+	if len(errs) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(errs))
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("Expected healthy rows to succeed, got: %v, %v", errs[0], errs[2])
+	}
+	if errs[1] == nil {
+		t.Error("Expected the poison row to fail on its own")
+	}
+	if len(publisher.published) != 2 {
+		t.Errorf("Expected index jobs only for inserted rows, got %d", len(publisher.published))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestCreateMessage_FailsWhenIndexJobCannotBePublished(t *testing.T) {
+	h, mock, publisher := newMockMessageHandler(t)
+	publisher.err = errors.New("channel closed")
+
+	mock.ExpectExec(`INSERT INTO messages`).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := h.CreateMessage(context.Background(), batchOfMessages()[0])
+	if err == nil {
+		t.Error("Expected the delivery to fail so the index job is retried")
+	}
+}
+
+func TestCreateMessage_DuplicateKeyIsTreatedAsApplied(t *testing.T) {
+	h, mock, publisher := newMockMessageHandler(t)
+
+	mock.ExpectExec(`INSERT INTO messages`).
+		WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'abc-1-1' for key 'index_messages_on_token_and_chat_number_and_number'"})
+
+	if err := h.CreateMessage(context.Background(), batchOfMessages()[0]); err != nil {
+		t.Fatalf("Expected redelivered message to succeed, got: %v", err)
+	}
+	if len(publisher.published) != 1 {
+		t.Errorf("Expected the index job to still be published, got %d", len(publisher.published))
+	}
+}
+
+func TestCreateMessages_DuplicateInBatchOnlyAffectsItsRow(t *testing.T) {
+	h, mock, publisher := newMockMessageHandler(t)
+	duplicate := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO messages`).WillReturnError(duplicate)
+	mock.ExpectRollback()
+	mock.ExpectExec(`INSERT INTO messages`).WillReturnError(duplicate)
+	mock.ExpectExec(`INSERT INTO messages`).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec(`INSERT INTO messages`).WillReturnResult(sqlmock.NewResult(3, 1))
+
+	for i, err := range h.CreateMessages(context.Background(), batchOfMessages()) {
+		if err != nil {
+			t.Errorf("Expected message %d to succeed, got: %v", i, err)
+		}
+	}
+	if len(publisher.published) != 3 {
+		t.Errorf("Expected an index job per message, got %d", len(publisher.published))
+	}
+}
+
+func TestDeleteMessage_SoftDeleteKeepsTombstone(t *testing.T) {
+	h, mock, publisher := newMockMessageHandler(t)
+
+	mock.ExpectExec(`UPDATE messages\s+SET deleted_at = NOW\(\), updated_at = NOW\(\)\s+WHERE token = \? AND chat_number = \? AND number = \? AND deleted_at IS NULL`).
+		WithArgs("abc", 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := h.DeleteMessage(context.Background(), models.DeleteMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(publisher.published) != 1 {
+		t.Errorf("Expected an index job to remove the document, got %d", len(publisher.published))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDeleteMessage_HardDeleteRemovesRow(t *testing.T) {
+	h, mock, _ := newMockMessageHandler(t)
+
+	mock.ExpectExec(`DELETE FROM message_revisions\s+WHERE token = \? AND chat_number = \? AND message_number = \?`).
+		WithArgs("abc", 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`DELETE FROM messages\s+WHERE token = \? AND chat_number = \? AND number = \?`).
+		WithArgs("abc", 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := h.DeleteMessage(context.Background(), models.DeleteMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2, Hard: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDeleteMessage_AlreadyDeletedIsNoOp(t *testing.T) {
+	h, mock, _ := newMockMessageHandler(t)
+
+	mock.ExpectExec(`UPDATE messages`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := h.DeleteMessage(context.Background(), models.DeleteMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2})
+	if err != nil {
+		t.Errorf("Expected redelivered delete to succeed, got: %v", err)
+	}
+}
+
+func TestUpdateMessage_RecordsPreviousBodyAsRevision(t *testing.T) {
+	h, mock, publisher := newMockMessageHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT body, edit_count, version\s+FROM messages\s+WHERE token = \? AND chat_number = \? AND number = \? AND deleted_at IS NULL\s+FOR UPDATE`).
+		WithArgs("abc", 1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"body", "edit_count", "version"}).AddRow("old", 1, 100))
+	mock.ExpectExec(`INSERT INTO message_revisions`).
+		WithArgs("abc", 1, 2, 2, "old", int64(7)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE messages\s+SET body = \?, edit_count = edit_count \+ 1, version = GREATEST\(version \+ 1, \?\)`).
+		WithArgs("new", int64(200), "abc", 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := h.UpdateMessage(context.Background(), models.UpdateMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2, EditorID: 7, Version: 200, Body: "new"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(publisher.published) != 1 {
+		t.Errorf("Expected an index job for the edited message, got %d", len(publisher.published))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUpdateMessage_SameBodyIsTreatedAsApplied(t *testing.T) {
+	h, mock, _ := newMockMessageHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT body, edit_count, version`).
+		WillReturnRows(sqlmock.NewRows([]string{"body", "edit_count", "version"}).AddRow("new", 1, 0))
+	mock.ExpectRollback()
+
+	err := h.UpdateMessage(context.Background(), models.UpdateMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2, Body: "new"})
+	if err != nil {
+		t.Fatalf("Expected redelivered update to succeed, got: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUpdateMessage_StaleVersionIsDropped(t *testing.T) {
+	h, mock, publisher := newMockMessageHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT body, edit_count, version`).
+		WillReturnRows(sqlmock.NewRows([]string{"body", "edit_count", "version"}).AddRow("newer", 2, 300))
+	mock.ExpectRollback()
+
+	err := h.UpdateMessage(context.Background(), models.UpdateMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2, Version: 200, Body: "older"})
+	if err != nil {
+		t.Fatalf("Expected stale update to be acked, got: %v", err)
+	}
+	if len(publisher.published) != 0 {
+		t.Errorf("Expected no index job for a stale update, got %d", len(publisher.published))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUpdateMessage_SameBodyRecordsVersionSoOlderUpdatesAreStale(t *testing.T) {
+	h, mock, _ := newMockMessageHandler(t)
+
+	// v2 carries the body the message already has
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT body, edit_count, version`).
+		WillReturnRows(sqlmock.NewRows([]string{"body", "edit_count", "version"}).AddRow("same", 1, 1))
+	mock.ExpectExec(`UPDATE messages\s+SET version = GREATEST\(version, \?\)`).
+		WithArgs(int64(2), "abc", 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// v1 arrives late with another body
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT body, edit_count, version`).
+		WillReturnRows(sqlmock.NewRows([]string{"body", "edit_count", "version"}).AddRow("same", 1, 2))
+	mock.ExpectRollback()
+
+	if err := h.UpdateMessage(context.Background(), models.UpdateMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2, Version: 2, Body: "same"}); err != nil {
+		t.Fatalf("Expected v2 to be applied, got: %v", err)
+	}
+	if err := h.UpdateMessage(context.Background(), models.UpdateMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2, Version: 1, Body: "older"}); err != nil {
+		t.Fatalf("Expected v1 to be acked as stale, got: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Expected v1's body to be rejected without a write: %v", err)
+	}
+}
+
+func TestUpdateMessage_MissingMessage(t *testing.T) {
+	h, mock, _ := newMockMessageHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT body, edit_count, version`).
+		WillReturnRows(sqlmock.NewRows([]string{"body", "edit_count", "version"}))
+	mock.ExpectRollback()
+
+	err := h.UpdateMessage(context.Background(), models.UpdateMessageMessage{Token: "abc", ChatNumber: 1, MessageNumber: 2, Body: "new"})
+	if err == nil {
+		t.Fatal("Expected an error for a missing message")
+	}
+	if kind, reason := failure.Classify(err); kind != failure.Permanent || reason != "message_not_found" {
+		t.Errorf("Expected a permanent message_not_found failure, got %s %s", kind, reason)
+	}
+}
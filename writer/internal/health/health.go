@@ -0,0 +1,160 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckTimeout bounds every individual check.
+const CheckTimeout = 2 * time.Second
+
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	StatusFailing  = "failing"
+)
+
+// CheckFunc returns nil when the dependency is healthy.
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name     string
+	critical bool
+	fn       CheckFunc
+}
+
+// Checker runs a set of named checks. A failing critical check fails the
+// whole report; a failing non-critical check only degrades it.
+type Checker struct {
+	checks []check
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the outcome of every check of a Checker.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Add registers a check. Critical checks make the report fail, others only
+// degrade it.
+func (c *Checker) Add(name string, critical bool, fn CheckFunc) {
+	c.checks = append(c.checks, check{name: name, critical: critical, fn: fn})
+}
+
+// Run executes every check concurrently, each bounded by CheckTimeout.
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(c.checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, chk := range c.checks {
+		wg.Add(1)
+		go func(chk check) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, CheckTimeout)
+			defer cancel()
+
+			err := chk.fn(checkCtx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				report.Checks[chk.name] = Result{Status: StatusOK}
+				return
+			}
+			if chk.critical {
+				report.Checks[chk.name] = Result{Status: StatusFailing, Error: err.Error()}
+				report.Status = StatusFailing
+				return
+			}
+			report.Checks[chk.name] = Result{Status: StatusDegraded, Error: err.Error()}
+			if report.Status == StatusOK {
+				report.Status = StatusDegraded
+			}
+		}(chk)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// Handler serves the report as JSON: 200 while ok or degraded, 503 once a
+// critical check fails.
+func (c *Checker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == StatusFailing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// Stalled checks that no consumer has held deliveries for longer than timeout
+// without finishing one, e.g. because a handler hangs. A consumer loop that
+// is still running counts as alive for Consumers even then. stalledFor
+// reports how long each consumer has been stuck, 0 while it isn't.
+func Stalled(timeout time.Duration, stalledFor func() map[string]time.Duration) CheckFunc {
+	return func(ctx context.Context) error {
+		var stalled []string
+		for name, d := range stalledFor() {
+			if d > timeout {
+				stalled = append(stalled, fmt.Sprintf("%s (%s)", name, d.Round(time.Second)))
+			}
+		}
+		if len(stalled) == 0 {
+			return nil
+		}
+		sort.Strings(stalled)
+		return fmt.Errorf("consumers stalled: %s", strings.Join(stalled, ", "))
+	}
+}
+
+// Consumers checks that every consumer in names is still running. With
+// subscribed set it also requires each one to be subscribed, rather than
+// waiting to resubscribe. status reports the running consumers and whether
+// they are subscribed.
+func Consumers(names []string, subscribed bool, status func() map[string]bool) CheckFunc {
+	return func(ctx context.Context) error {
+		running := status()
+
+		var stopped, unsubscribed []string
+		for _, name := range names {
+			isSubscribed, ok := running[name]
+			switch {
+			case !ok:
+				stopped = append(stopped, name)
+			case subscribed && !isSubscribed:
+				unsubscribed = append(unsubscribed, name)
+			}
+		}
+		sort.Strings(stopped)
+		sort.Strings(unsubscribed)
+
+		switch {
+		case len(stopped) > 0:
+			return fmt.Errorf("consumers stopped: %s", strings.Join(stopped, ", "))
+		case len(unsubscribed) > 0:
+			return fmt.Errorf("consumers not subscribed: %s", strings.Join(unsubscribed, ", "))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func ok(ctx context.Context) error { return nil }
+
+func failing(ctx context.Context) error { return errors.New("down") }
+
+func TestChecker_Run(t *testing.T) {
+	tests := []struct {
+		name     string
+		critical CheckFunc
+		optional CheckFunc
+		expected string
+	}{
+		{"all ok", ok, ok, StatusOK},
+		{"optional failing", ok, failing, StatusDegraded},
+		{"critical failing", failing, ok, StatusFailing},
+		{"both failing", failing, failing, StatusFailing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker()
+			checker.Add("mysql", true, tt.critical)
+			checker.Add("elasticsearch", false, tt.optional)
+
+			report := checker.Run(context.Background())
+			if report.Status != tt.expected {
+				t.Errorf("Status = %q, want %q", report.Status, tt.expected)
+			}
+			if len(report.Checks) != 2 {
+				t.Errorf("expected 2 check results, got %d", len(report.Checks))
+			}
+		})
+	}
+}
+
+func TestChecker_HandlerStatusCodes(t *testing.T) {
+	degraded := NewChecker()
+	degraded.Add("elasticsearch", false, failing)
+
+	rec := httptest.NewRecorder()
+	degraded.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("degraded: expected 200, got %d", rec.Code)
+	}
+
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	if got := report.Checks["elasticsearch"]; got.Status != StatusDegraded || got.Error != "down" {
+		t.Errorf("elasticsearch = %+v, want degraded with error", got)
+	}
+
+	failed := NewChecker()
+	failed.Add("mysql", true, failing)
+
+	rec = httptest.NewRecorder()
+	failed.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("failing: expected 503, got %d", rec.Code)
+	}
+}
+
+func TestConsumers(t *testing.T) {
+	status := func() map[string]bool {
+		return map[string]bool{"create_chats": true, "create_messages": false}
+	}
+
+	if err := Consumers([]string{"create_chats", "create_messages"}, false, status)(context.Background()); err != nil {
+		t.Errorf("liveness: expected running consumers to pass, got %v", err)
+	}
+
+	err := Consumers([]string{"create_chats", "create_messages"}, true, status)(context.Background())
+	if err == nil || err.Error() != "consumers not subscribed: create_messages" {
+		t.Errorf("readiness: unexpected error %v", err)
+	}
+
+	err = Consumers([]string{"create_chats", "delete_chats"}, false, status)(context.Background())
+	if err == nil || err.Error() != "consumers stopped: delete_chats" {
+		t.Errorf("liveness: unexpected error %v", err)
+	}
+}
+
+func TestStalled(t *testing.T) {
+	stalls := map[string]time.Duration{"create_chats": 0, "create_messages": time.Minute, "delete_chats": 10 * time.Minute}
+	check := Stalled(5*time.Minute, func() map[string]time.Duration { return stalls })
+
+	err := check(context.Background())
+	if err == nil || err.Error() != "consumers stalled: delete_chats (10m0s)" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	stalls["delete_chats"] = 0
+	if err := check(context.Background()); err != nil {
+		t.Errorf("expected consumers making progress to pass, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		level    string
+		expected slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"INFO", slog.LevelInfo},
+		{"warn", slog.LevelWarn},
+		{"error", slog.LevelError},
+		{"", slog.LevelInfo},
+		{"verbose", slog.LevelInfo},
+	}
+
+	for _, tt := range tests {
+		if got := ParseLevel(tt.level); got != tt.expected {
+			t.Errorf("ParseLevel(%q) = %v, want %v", tt.level, got, tt.expected)
+		}
+	}
+}
+
+func TestWith_AddsFieldsToContextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := NewContext(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	ctx = With(ctx, "queue", "create_chats")
+	ctx = With(ctx, "token", "abc")
+	FromContext(ctx).Info("processed")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("failed to decode log line %q: %v", buf.String(), err)
+	}
+	if line["queue"] != "create_chats" || line["token"] != "abc" {
+		t.Errorf("expected queue and token fields, got %v", line)
+	}
+}
+
+func TestFromContext_FallsBackToDefault(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Error("expected the default logger for a context without one")
+	}
+}
@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "writer"
+
+// Delivery outcomes recorded in DeliveriesTotal.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeInvalid   = "invalid"
+	OutcomeRequeued  = "requeued"
+)
+
+// Reasons recorded in DeadLetteredTotal.
+const (
+	ReasonMaxRetries     = "max_retries"
+	ReasonInvalidPayload = "invalid_payload"
+	ReasonRetryFailed    = "retry_failed"
+	ReasonPermanent      = "permanent"
+	ReasonMaxAge         = "max_age"
+)
+
+var (
+	DeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deliveries_total",
+		Help:      "Deliveries processed per queue, by outcome (succeeded, failed, invalid, requeued).",
+	}, []string{"queue", "outcome"})
+
+	HandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent in a queue handler call; a batch handler call is observed once per batch.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"queue"})
+
+	RetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Failed deliveries republished to a delay queue for another attempt.",
+	}, []string{"queue"})
+
+	RetryRequeuesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retry_requeues_total",
+		Help:      "Failed deliveries requeued on their own queue because the broker didn't confirm their republish to a delay queue.",
+	}, []string{"queue"})
+
+	DeadLetteredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dead_lettered_total",
+		Help:      "Deliveries sent to the dead letter queue, by reason.",
+	}, []string{"queue", "reason"})
+
+	ElasticsearchItemsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "elasticsearch_items_total",
+		Help:      "Bulk indexer items by action and outcome (succeeded, retried, failed, conflict).",
+	}, []string{"action", "outcome"})
+
+	CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of each circuit breaker: 0 closed, 1 open, 2 half-open.",
+	}, []string{"breaker"})
+
+	ConcurrencyLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "concurrency_limit",
+		Help:      "Deliveries the consumers may handle at once, lowered while MySQL connections are contended.",
+	})
+
+	InFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "in_flight",
+		Help:      "Deliveries being handled across all consumers.",
+	})
+
+	CronRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_runs_total",
+		Help:      "Cron job runs on this replica, by job and outcome (succeeded, failed).",
+	}, []string{"job", "outcome"})
+
+	CronSkippedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_skipped_total",
+		Help:      "Cron schedule slots skipped because the job's previous run was still going.",
+	}, []string{"job"})
+
+	CronLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cron_last_success_timestamp_seconds",
+		Help:      "Unix time the job's last successful run finished.",
+	}, []string{"job"})
+
+	CronLastRunFailed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cron_last_run_failed",
+		Help:      "1 if the job's last run failed, 0 if it succeeded.",
+	}, []string{"job"})
+
+	CountSyncDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "count_sync_duration_seconds",
+		Help:      "Duration of a count sync run.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	CountSyncKeysTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "count_sync_keys_total",
+		Help:      "Changed counters processed by the count sync, by change set and outcome (synced, failed).",
+	}, []string{"set", "outcome"})
+)
+
+// RegisterDB exports the connection pool stats of db as mysql_* metrics.
+func RegisterDB(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "mysql"))
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
 
 type CreateChatMessage struct {
 	Token      string `json:"token"`
@@ -17,13 +21,106 @@ type CreateMessageMessage struct {
 	Date          string `json:"date"`
 }
 
+// UpdateMessageMessage replaces a message's body. EditorID is recorded on
+// the revision that keeps the previous body. Version orders updates of the
+// same message (the API sends the request time in microseconds); an update
+// is only applied if its version is newer than the stored one. Zero means
+// unversioned and is always applied.
 type UpdateMessageMessage struct {
 	Token         string `json:"token"`
 	ChatNumber    int    `json:"chatNumber"`
 	MessageNumber int    `json:"messageNumber"`
+	EditorID      int    `json:"editorId"`
+	Version       int64  `json:"version"`
 	Body          string `json:"body"`
 }
 
+// DeleteMessageMessage removes a message. By default the row is kept as a
+// tombstone with deleted_at set; Hard removes the row entirely.
+type DeleteMessageMessage struct {
+	Token         string `json:"token"`
+	ChatNumber    int    `json:"chatNumber"`
+	MessageNumber int    `json:"messageNumber"`
+	Hard          bool   `json:"hard"`
+}
+
+// DeleteChatMessage removes a chat together with its messages.
+type DeleteChatMessage struct {
+	Token      string `json:"token"`
+	ChatNumber int    `json:"chatNumber"`
+}
+
+// DeleteApplicationMessage removes an application with all its chats and messages.
+type DeleteApplicationMessage struct {
+	Token string `json:"token"`
+}
+
+// IndexMessageMessage asks the index_messages consumer to bring the search
+// document for a message in line with its current row in MySQL.
+type IndexMessageMessage struct {
+	Token         string `json:"token"`
+	ChatNumber    int    `json:"chatNumber"`
+	MessageNumber int    `json:"messageNumber"`
+}
+
+// OrderingKey keeps deliveries for the same chat on the same consumer worker.
+func (m CreateChatMessage) OrderingKey() string {
+	return fmt.Sprintf("%s:%d", m.Token, m.ChatNumber)
+}
+
+func (m CreateMessageMessage) OrderingKey() string {
+	return fmt.Sprintf("%s:%d", m.Token, m.ChatNumber)
+}
+
+func (m UpdateMessageMessage) OrderingKey() string {
+	return fmt.Sprintf("%s:%d", m.Token, m.ChatNumber)
+}
+
+func (m DeleteMessageMessage) OrderingKey() string {
+	return fmt.Sprintf("%s:%d", m.Token, m.ChatNumber)
+}
+
+func (m DeleteChatMessage) OrderingKey() string {
+	return fmt.Sprintf("%s:%d", m.Token, m.ChatNumber)
+}
+
+func (m DeleteApplicationMessage) OrderingKey() string {
+	return m.Token
+}
+
+func (m IndexMessageMessage) OrderingKey() string {
+	return fmt.Sprintf("%s:%d", m.Token, m.ChatNumber)
+}
+
+// LogAttrs identify the payload's application, chat and message in log lines.
+func (m CreateChatMessage) LogAttrs() []any {
+	return []any{slog.String("token", m.Token), slog.Int("chat_number", m.ChatNumber)}
+}
+
+func (m CreateMessageMessage) LogAttrs() []any {
+	return []any{slog.String("token", m.Token), slog.Int("chat_number", m.ChatNumber), slog.Int("message_number", m.MessageNumber)}
+}
+
+func (m UpdateMessageMessage) LogAttrs() []any {
+	return []any{slog.String("token", m.Token), slog.Int("chat_number", m.ChatNumber), slog.Int("message_number", m.MessageNumber)}
+}
+
+func (m DeleteMessageMessage) LogAttrs() []any {
+	return []any{slog.String("token", m.Token), slog.Int("chat_number", m.ChatNumber), slog.Int("message_number", m.MessageNumber)}
+}
+
+func (m DeleteChatMessage) LogAttrs() []any {
+	return []any{slog.String("token", m.Token), slog.Int("chat_number", m.ChatNumber)}
+}
+
+func (m DeleteApplicationMessage) LogAttrs() []any {
+	return []any{slog.String("token", m.Token)}
+}
+
+func (m IndexMessageMessage) LogAttrs() []any {
+	return []any{slog.String("token", m.Token), slog.Int("chat_number", m.ChatNumber), slog.Int("message_number", m.MessageNumber)}
+}
+
 type Chat struct {
 	ID            int
 	Token         string
@@ -0,0 +1,20 @@
+// Package progress lets long-running work report that it is still moving, so
+// it isn't mistaken for being stuck.
+package progress
+
+import "context"
+
+type touchKey struct{}
+
+// NewContext returns a copy of ctx whose Touch calls touch.
+func NewContext(ctx context.Context, touch func()) context.Context {
+	return context.WithValue(ctx, touchKey{}, touch)
+}
+
+// Touch reports progress to whoever started ctx's work. It does nothing for
+// contexts without a reporter.
+func Touch(ctx context.Context) {
+	if touch, ok := ctx.Value(touchKey{}).(func()); ok {
+		touch()
+	}
+}
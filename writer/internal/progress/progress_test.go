@@ -0,0 +1,20 @@
+package progress
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTouch(t *testing.T) {
+	touched := 0
+	ctx := NewContext(context.Background(), func() { touched++ })
+
+	Touch(ctx)
+	Touch(ctx)
+	if touched != 2 {
+		t.Errorf("expected 2 touches, got %d", touched)
+	}
+
+	// Without a reporter Touch is a no-op
+	Touch(context.Background())
+}
@@ -0,0 +1,469 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chat/writer/internal/backpressure"
+	"github.com/chat/writer/internal/breaker"
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/logging"
+	"github.com/chat/writer/internal/metrics"
+	"github.com/chat/writer/internal/progress"
+	"github.com/chat/writer/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Runner is implemented by every consumer so main can start them uniformly.
+type Runner interface {
+	Start(ctx context.Context)
+	QueueName() string
+	StalledFor() time.Duration
+}
+
+// HandlerFunc processes a single decoded payload. A non-nil error sends the
+// delivery through the retry handler.
+type HandlerFunc[T any] func(ctx context.Context, payload T) error
+
+// BatchHandlerFunc processes several decoded payloads at once and returns one
+// error per payload, in the same order, so each delivery is acked or retried
+// on its own outcome.
+type BatchHandlerFunc[T any] func(ctx context.Context, payloads []T) []error
+
+// Keyed payloads are always routed to the same worker for the same key, so
+// deliveries sharing a key are processed in the order they were received.
+type Keyed interface {
+	OrderingKey() string
+}
+
+// Loggable payloads add the attributes identifying them to every log line
+// written about their delivery.
+type Loggable interface {
+	LogAttrs() []any
+}
+
+// Consumer consumes JSON payloads of type T from a single queue, declaring
+// the queue with its DLQ and applying the shared retry policy on failure.
+type Consumer[T any] struct {
+	rabbit       *RabbitMQ
+	queueName    string
+	settings     config.QueueConfig
+	handler      HandlerFunc[T]
+	batchHandler BatchHandlerFunc[T]
+	retryHandler *RetryHandler
+	// breakers guard the dependencies the handler needs; consumption pauses
+	// while any of them is open
+	breakers []*breaker.Breaker
+	// limiter bounds the deliveries handled at once across consumers
+	limiter *backpressure.Limiter
+
+	// pending counts deliveries handed to workers and not finished yet;
+	// lastProgress is when one last finished, in Unix nanoseconds
+	pending      atomic.Int64
+	lastProgress atomic.Int64
+}
+
+type job[T any] struct {
+	msg     amqp.Delivery
+	payload T
+	// log carries the queue, delivery tag and retry count of msg
+	log *slog.Logger
+	// span covers the delivery from dispatch until it is acked, retried or
+	// handed back
+	span trace.Span
+}
+
+// logger returns j.log with the payload's own attributes added.
+func (j job[T]) logger() *slog.Logger {
+	if loggable, ok := any(j.payload).(Loggable); ok {
+		return j.log.With(loggable.LogAttrs()...)
+	}
+	return j.log
+}
+
+func NewConsumer[T any](rabbit *RabbitMQ, queueName string, settings config.QueueConfig, handler HandlerFunc[T]) *Consumer[T] {
+	if settings.Workers < 1 {
+		settings.Workers = 1
+	}
+	if settings.Prefetch < settings.Workers {
+		settings.Prefetch = settings.Workers
+	}
+
+	return &Consumer[T]{
+		rabbit:       rabbit,
+		queueName:    queueName,
+		settings:     settings,
+		handler:      handler,
+		retryHandler: NewRetryHandler(settings.Retry, NewPublisher(rabbit)),
+	}
+}
+
+// NewBatchConsumer is like NewConsumer, but each worker accumulates up to
+// settings.BatchSize deliveries (or waits at most settings.BatchWindow) and
+// hands them to handler together.
+func NewBatchConsumer[T any](rabbit *RabbitMQ, queueName string, settings config.QueueConfig, handler BatchHandlerFunc[T]) *Consumer[T] {
+	if settings.BatchSize < 1 {
+		settings.BatchSize = 1
+	}
+	c := NewConsumer[T](rabbit, queueName, settings, nil)
+	c.batchHandler = handler
+	return c
+}
+
+// PauseWhileOpen makes c stop consuming while any of breakers is open, and
+// requeue deliveries that failed while it was, instead of retrying them.
+func (c *Consumer[T]) PauseWhileOpen(breakers ...*breaker.Breaker) *Consumer[T] {
+	c.breakers = append(c.breakers, breakers...)
+	return c
+}
+
+// LimitBy makes c's workers take a slot from limiter for every delivery, or
+// batch, they handle. While no slot is free the prefetched deliveries stay
+// unacknowledged, so the broker stops sending more until one frees up.
+func (c *Consumer[T]) LimitBy(limiter *backpressure.Limiter) *Consumer[T] {
+	c.limiter = limiter
+	return c
+}
+
+func (c *Consumer[T]) QueueName() string {
+	return c.queueName
+}
+
+// StalledFor reports how long c has held deliveries without finishing any,
+// or 0 while it has none. It grows while a handler hangs or workers are
+// blocked, and resets whenever a delivery is acked, retried or handed back,
+// or a handler reports progress with progress.Touch.
+func (c *Consumer[T]) StalledFor() time.Duration {
+	if c.pending.Load() == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, c.lastProgress.Load()))
+}
+
+// started counts a delivery handed to a worker. The stall clock starts when
+// c goes from idle to busy.
+func (c *Consumer[T]) started() {
+	if c.pending.Add(1) == 1 {
+		c.lastProgress.Store(time.Now().UnixNano())
+	}
+}
+
+// touch resets the stall clock while a long handler call is still moving.
+func (c *Consumer[T]) touch() {
+	c.lastProgress.Store(time.Now().UnixNano())
+}
+
+// finished counts n deliveries a worker is done with.
+func (c *Consumer[T]) finished(n int) {
+	c.touch()
+	c.pending.Add(-int64(n))
+}
+
+// Start consumes until ctx is cancelled, resubscribing after connection loss.
+func (c *Consumer[T]) Start(ctx context.Context) {
+	c.rabbit.RunConsumer(ctx, c.queueName, c.consume)
+}
+
+func (c *Consumer[T]) consume(ctx context.Context, ch *amqp.Channel) error {
+	q, err := c.rabbit.DeclareQueueWithDLQ(ch, c.queueName)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue with DLQ: %w", err)
+	}
+	if err := c.retryHandler.DeclareRetryTiers(ch, c.queueName); err != nil {
+		return err
+	}
+
+	msgs, err := c.rabbit.Consume(ch, q.Name, c.settings.Prefetch)
+	if err != nil {
+		return fmt.Errorf("failed to register consumer: %w", err)
+	}
+
+	workers := c.startWorkers(ctx)
+	defer workers.stop()
+
+	slog.Info("Waiting for messages", "queue", c.queueName,
+		"workers", c.settings.Workers, "prefetch", c.settings.Prefetch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down gracefully", "queue", c.queueName)
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			if err := c.waitForBreakers(ctx); err != nil {
+				msg.Nack(false, true)
+				return nil
+			}
+			c.dispatch(workers, msg)
+		}
+	}
+}
+
+type workerPool[T any] struct {
+	inboxes []chan job[T]
+	wg      sync.WaitGroup
+}
+
+// stop closes every inbox and waits for in-flight deliveries to finish.
+func (p *workerPool[T]) stop() {
+	for _, inbox := range p.inboxes {
+		close(inbox)
+	}
+	p.wg.Wait()
+}
+
+func (c *Consumer[T]) startWorkers(ctx context.Context) *workerPool[T] {
+	pool := &workerPool[T]{
+		inboxes: make([]chan job[T], c.settings.Workers),
+	}
+	// Deliveries already handed to a worker are allowed to finish on shutdown
+	handlerCtx := context.WithoutCancel(ctx)
+
+	for i := range pool.inboxes {
+		inbox := make(chan job[T], c.settings.Prefetch/c.settings.Workers)
+		pool.inboxes[i] = inbox
+
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			if c.batchHandler != nil {
+				c.runBatchWorker(ctx, handlerCtx, inbox)
+				return
+			}
+			for j := range inbox {
+				if ctx.Err() != nil || c.limiter.Acquire(ctx) != nil {
+					// Not started yet - hand it back to the broker
+					j.msg.Nack(false, true)
+					j.span.End()
+					c.finished(1)
+					continue
+				}
+				c.handle(handlerCtx, j)
+				c.limiter.Release()
+				c.finished(1)
+			}
+		}()
+	}
+
+	return pool
+}
+
+// runBatchWorker collects jobs from inbox until the batch is full or the
+// batch window expires, then processes them with the batch handler.
+func (c *Consumer[T]) runBatchWorker(ctx, handlerCtx context.Context, inbox <-chan job[T]) {
+	batch := make([]job[T], 0, c.settings.BatchSize)
+
+	for first := range inbox {
+		batch = append(batch[:0], first)
+		window := time.NewTimer(c.settings.BatchWindow)
+
+	collect:
+		for len(batch) < c.settings.BatchSize {
+			select {
+			case j, ok := <-inbox:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, j)
+			case <-window.C:
+				break collect
+			}
+		}
+		window.Stop()
+
+		if ctx.Err() != nil || c.limiter.Acquire(ctx) != nil {
+			// Not started yet - hand them back to the broker
+			for _, j := range batch {
+				j.msg.Nack(false, true)
+				j.span.End()
+			}
+			c.finished(len(batch))
+			continue
+		}
+		c.handleBatch(handlerCtx, batch)
+		c.limiter.Release()
+		c.finished(len(batch))
+	}
+}
+
+// dispatch decodes msg and routes it to a worker chosen by its ordering key.
+// It starts the delivery's span as a child of the trace context in msg's
+// headers.
+func (c *Consumer[T]) dispatch(pool *workerPool[T], msg amqp.Delivery) {
+	retryCount := c.retryHandler.GetRetryCount(msg)
+	_, span := tracing.Tracer().Start(extractTrace(context.Background(), msg.Headers), c.queueName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationDeliver,
+			semconv.MessagingDestinationName(c.queueName),
+			attribute.Int("messaging.rabbitmq.retry_count", retryCount),
+		))
+
+	logger := slog.With(
+		slog.String("queue", c.queueName),
+		slog.Uint64("delivery_tag", msg.DeliveryTag),
+		slog.Int("retry_count", retryCount),
+	)
+	if span.SpanContext().IsValid() {
+		logger = logger.With(slog.String("trace_id", span.SpanContext().TraceID().String()))
+	}
+
+	// Log retry metrics if this is a retry
+	c.retryHandler.LogRetryMetrics(logger, msg)
+
+	var payload T
+	if err := json.Unmarshal(msg.Body, &payload); err != nil {
+		logger.Error("Error unmarshaling message", "error", err)
+		// Parsing errors shouldn't be retried - send to DLQ
+		msg.Nack(false, false)
+		metrics.DeliveriesTotal.WithLabelValues(c.queueName, metrics.OutcomeInvalid).Inc()
+		metrics.DeadLetteredTotal.WithLabelValues(c.queueName, metrics.ReasonInvalidPayload).Inc()
+		tracing.End(span, err)
+		return
+	}
+
+	c.started()
+	pool.inboxes[workerFor(payload, msg, len(pool.inboxes))] <- job[T]{msg: msg, payload: payload, log: logger, span: span}
+}
+
+// waitForBreakers blocks while any of c's breakers is open. The deliveries
+// prefetched meanwhile stay unacknowledged, so the broker stops sending more
+// until consumption resumes.
+func (c *Consumer[T]) waitForBreakers(ctx context.Context) error {
+	for _, b := range c.breakers {
+		if b.State() == breaker.Closed {
+			continue
+		}
+		slog.Warn("Pausing consumption while circuit breaker is open", "queue", c.queueName, "breaker", b.Name())
+		if err := b.Wait(ctx); err != nil {
+			return err
+		}
+		slog.Info("Resuming consumption", "queue", c.queueName, "breaker", b.Name())
+	}
+	return nil
+}
+
+// breakerOpen reports whether err came from an open breaker, or any of c's
+// breakers opened since, so the failure is blamed on the dependency.
+func (c *Consumer[T]) breakerOpen(err error) bool {
+	if errors.Is(err, breaker.ErrOpen) {
+		return true
+	}
+	for _, b := range c.breakers {
+		if b.State() != breaker.Closed {
+			return true
+		}
+	}
+	return false
+}
+
+// workerFor hashes the payload's ordering key onto a worker index. Payloads
+// without a key are spread round-robin by delivery tag.
+func workerFor(payload any, msg amqp.Delivery, workers int) int {
+	if workers == 1 {
+		return 0
+	}
+	keyed, ok := payload.(Keyed)
+	if !ok {
+		return int(msg.DeliveryTag % uint64(workers))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(keyed.OrderingKey()))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// handle runs the handler for one delivery. Its context carries the
+// delivery's logger with the payload's attributes and a handler span under
+// the delivery's span.
+func (c *Consumer[T]) handle(ctx context.Context, j job[T]) {
+	ctx = trace.ContextWithSpan(ctx, j.span)
+	handlerCtx, span := tracing.Tracer().Start(ctx, c.queueName+" handle")
+
+	start := time.Now()
+	handlerCtx = progress.NewContext(handlerCtx, c.touch)
+	err := c.handler(logging.NewContext(handlerCtx, j.logger()), j.payload)
+	metrics.HandlerDuration.WithLabelValues(c.queueName).Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
+
+	c.complete(ctx, j, err)
+}
+
+func (c *Consumer[T]) handleBatch(ctx context.Context, batch []job[T]) {
+	payloads := make([]T, len(batch))
+	for i, j := range batch {
+		payloads[i] = j.payload
+	}
+
+	// A batch has no single parent, so its span links to every delivery's
+	links := make([]trace.Link, len(batch))
+	for i, j := range batch {
+		links[i] = trace.Link{SpanContext: j.span.SpanContext()}
+	}
+	batchCtx, span := tracing.Tracer().Start(ctx, c.queueName+" handle batch",
+		trace.WithLinks(links...),
+		trace.WithAttributes(semconv.MessagingBatchMessageCount(len(batch))))
+	batchCtx = logging.With(batchCtx, slog.String("queue", c.queueName), slog.Int("batch_size", len(batch)))
+	batchCtx = progress.NewContext(batchCtx, c.touch)
+
+	start := time.Now()
+	errs := c.batchHandler(batchCtx, payloads)
+	metrics.HandlerDuration.WithLabelValues(c.queueName).Observe(time.Since(start).Seconds())
+	span.End()
+
+	for i, j := range batch {
+		var err error
+		if i < len(errs) {
+			err = errs[i]
+		} else {
+			err = fmt.Errorf("batch handler returned %d results for %d payloads", len(errs), len(batch))
+		}
+		c.complete(trace.ContextWithSpan(ctx, j.span), j, err)
+	}
+}
+
+// complete acks the delivery on success, otherwise routes it through the
+// retry handler. It ends the delivery's span; ctx must carry that span so a
+// retry continues its trace.
+func (c *Consumer[T]) complete(ctx context.Context, j job[T], err error) {
+	msg := j.msg
+	logger := j.logger()
+	defer tracing.End(j.span, err)
+
+	if err != nil && c.breakerOpen(err) {
+		// Not the delivery's fault: keep it for when the dependency is back
+		// rather than spending its retries or dead-lettering it
+		logger.Warn("Dependency unavailable, requeueing message", "error", err)
+		msg.Nack(false, true)
+		metrics.DeliveriesTotal.WithLabelValues(c.queueName, metrics.OutcomeRequeued).Inc()
+		return
+	}
+	if err != nil {
+		logger.Error("Error processing message", "error", err)
+		metrics.DeliveriesTotal.WithLabelValues(c.queueName, metrics.OutcomeFailed).Inc()
+		// Use retry handler with exponential backoff
+		if retryErr := c.retryHandler.HandleFailedMessage(logging.NewContext(ctx, logger), msg, c.queueName, err); retryErr != nil {
+			logger.Error("Error handling retry", "error", retryErr)
+			msg.Nack(false, false)
+			metrics.DeadLetteredTotal.WithLabelValues(c.queueName, metrics.ReasonRetryFailed).Inc()
+		}
+		return
+	}
+
+	msg.Ack(false)
+	metrics.DeliveriesTotal.WithLabelValues(c.queueName, metrics.OutcomeSucceeded).Inc()
+	logger.Info("Processed message")
+}
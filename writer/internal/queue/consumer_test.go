@@ -0,0 +1,442 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chat/writer/internal/backpressure"
+	"github.com/chat/writer/internal/breaker"
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/logging"
+	"github.com/chat/writer/internal/metrics"
+	"github.com/chat/writer/internal/progress"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type fakeAcknowledger struct {
+	acked   bool
+	nacked  bool
+	requeue bool
+}
+
+func (f *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	f.acked = true
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	f.nacked = true
+	f.requeue = requeue
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return f.Nack(tag, false, requeue)
+}
+
+type testPayload struct {
+	Token string `json:"token"`
+	Seq   int    `json:"seq"`
+}
+
+func (p testPayload) OrderingKey() string {
+	return p.Token
+}
+
+func (p testPayload) LogAttrs() []any {
+	return []any{slog.String("token", p.Token)}
+}
+
+func TestConsumerHandle_AcksOnSuccess(t *testing.T) {
+	var received testPayload
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{}, func(ctx context.Context, p testPayload) error {
+		received = p
+		return nil
+	})
+	pool := c.startWorkers(context.Background())
+
+	ack := &fakeAcknowledger{}
+	c.dispatch(pool, amqp.Delivery{
+		Acknowledger: ack,
+		Body:         []byte(`{"token":"abc"}`),
+	})
+	pool.stop()
+
+	if received.Token != "abc" {
+		t.Errorf("Expected payload token 'abc', got %q", received.Token)
+	}
+	if !ack.acked || ack.nacked {
+		t.Errorf("Expected delivery to be acked, got acked=%v nacked=%v", ack.acked, ack.nacked)
+	}
+}
+
+func TestConsumerHandle_InvalidJSONGoesToDLQ(t *testing.T) {
+	called := false
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{}, func(ctx context.Context, p testPayload) error {
+		called = true
+		return nil
+	})
+	pool := c.startWorkers(context.Background())
+
+	ack := &fakeAcknowledger{}
+	c.dispatch(pool, amqp.Delivery{
+		Acknowledger: ack,
+		Body:         []byte(`not json`),
+	})
+	pool.stop()
+
+	if called {
+		t.Error("Handler should not be called for invalid payloads")
+	}
+	if !ack.nacked || ack.requeue {
+		t.Errorf("Expected nack without requeue, got nacked=%v requeue=%v", ack.nacked, ack.requeue)
+	}
+}
+
+func TestConsumer_RecordsDeliveryMetrics(t *testing.T) {
+	c := NewConsumer(nil, "metrics_queue", config.QueueConfig{}, func(ctx context.Context, p testPayload) error {
+		return nil
+	})
+	pool := c.startWorkers(context.Background())
+
+	c.dispatch(pool, amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(`{"token":"abc"}`)})
+	c.dispatch(pool, amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(`not json`)})
+	pool.stop()
+
+	if n := testutil.ToFloat64(metrics.DeliveriesTotal.WithLabelValues("metrics_queue", metrics.OutcomeSucceeded)); n != 1 {
+		t.Errorf("Expected 1 succeeded delivery, got %v", n)
+	}
+	if n := testutil.ToFloat64(metrics.DeadLetteredTotal.WithLabelValues("metrics_queue", metrics.ReasonInvalidPayload)); n != 1 {
+		t.Errorf("Expected 1 dead-lettered delivery, got %v", n)
+	}
+	if n := testutil.CollectAndCount(metrics.HandlerDuration, "writer_handler_duration_seconds"); n == 0 {
+		t.Error("Expected handler latency to be observed")
+	}
+}
+
+func TestConsumerHandle_RequeuesWhileBreakerOpen(t *testing.T) {
+	c := NewConsumer(nil, "breaker_queue", config.QueueConfig{}, func(ctx context.Context, p testPayload) error {
+		return fmt.Errorf("failed to insert: %w", breaker.ErrOpen)
+	})
+	pool := c.startWorkers(context.Background())
+
+	ack := &fakeAcknowledger{}
+	c.dispatch(pool, amqp.Delivery{Acknowledger: ack, Body: []byte(`{"token":"abc"}`)})
+	pool.stop()
+
+	if !ack.nacked || !ack.requeue {
+		t.Errorf("Expected nack with requeue, got nacked=%v requeue=%v", ack.nacked, ack.requeue)
+	}
+	if n := testutil.ToFloat64(metrics.DeliveriesTotal.WithLabelValues("breaker_queue", metrics.OutcomeRequeued)); n != 1 {
+		t.Errorf("Expected 1 requeued delivery, got %v", n)
+	}
+}
+
+func TestConsumer_WaitsForOpenBreakers(t *testing.T) {
+	var probeOK atomic.Bool
+	b := breaker.New("test", config.BreakerConfig{FailureThreshold: 1, Cooldown: 5 * time.Millisecond},
+		func(ctx context.Context) error {
+			if probeOK.Load() {
+				return nil
+			}
+			return errors.New("still down")
+		},
+		func(err error) bool { return true })
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{}, func(ctx context.Context, p testPayload) error {
+		return nil
+	}).PauseWhileOpen(nil, b)
+	b.Record(errors.New("connection refused"))
+
+	resumed := make(chan error, 1)
+	go func() {
+		resumed <- c.waitForBreakers(context.Background())
+	}()
+
+	select {
+	case <-resumed:
+		t.Fatal("Expected consumption to pause while the breaker is open")
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	probeOK.Store(true)
+	select {
+	case err := <-resumed:
+		if err != nil {
+			t.Errorf("Expected consumption to resume, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Consumption did not resume after the breaker closed")
+	}
+}
+
+func TestConsumer_WorkersShareTheLimiter(t *testing.T) {
+	limiter := backpressure.New(config.BackpressureConfig{MaxInFlight: 2}, func() sql.DBStats { return sql.DBStats{} })
+	var running, peak atomic.Int32
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{Prefetch: 16, Workers: 8}, func(ctx context.Context, p testPayload) error {
+		n := running.Add(1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		return nil
+	}).LimitBy(limiter)
+	pool := c.startWorkers(context.Background())
+
+	acks := make([]*fakeAcknowledger, 16)
+	for i := range acks {
+		acks[i] = &fakeAcknowledger{}
+		body := fmt.Sprintf(`{"token":"t:%d"}`, i)
+		c.dispatch(pool, amqp.Delivery{Acknowledger: acks[i], Body: []byte(body)})
+	}
+	pool.stop()
+
+	if peak.Load() > 2 {
+		t.Errorf("Expected at most 2 deliveries handled at once, got %d", peak.Load())
+	}
+	for i, ack := range acks {
+		if !ack.acked {
+			t.Errorf("Expected delivery %d to be acked", i)
+		}
+	}
+}
+
+func TestConsumer_StalledForTracksHeldDeliveries(t *testing.T) {
+	release := make(chan struct{})
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{Prefetch: 4, Workers: 1}, func(ctx context.Context, p testPayload) error {
+		<-release
+		return nil
+	})
+	if c.StalledFor() != 0 {
+		t.Fatalf("Expected an idle consumer not to be stalled, got %v", c.StalledFor())
+	}
+
+	pool := c.startWorkers(context.Background())
+	c.dispatch(pool, amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(`{"token":"abc"}`)})
+	time.Sleep(20 * time.Millisecond)
+	if c.StalledFor() < 20*time.Millisecond {
+		t.Errorf("Expected a hanging handler to stall the consumer, got %v", c.StalledFor())
+	}
+
+	close(release)
+	pool.stop()
+	if c.StalledFor() != 0 {
+		t.Errorf("Expected the consumer to be idle once the delivery finished, got %v", c.StalledFor())
+	}
+}
+
+func TestConsumer_ReportedProgressIsNotAStall(t *testing.T) {
+	touched := make(chan struct{})
+	release := make(chan struct{})
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{Prefetch: 4, Workers: 1}, func(ctx context.Context, p testPayload) error {
+		// A long cascade deleting chunk after chunk
+		for i := 0; i < 4; i++ {
+			time.Sleep(15 * time.Millisecond)
+			progress.Touch(ctx)
+			touched <- struct{}{}
+		}
+		<-release
+		return nil
+	})
+	pool := c.startWorkers(context.Background())
+	defer pool.stop()
+	defer close(release)
+
+	start := time.Now()
+	c.dispatch(pool, amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(`{"token":"abc"}`)})
+	for i := 0; i < 4; i++ {
+		<-touched
+	}
+
+	running := time.Since(start)
+	if stalled := c.StalledFor(); stalled <= 0 || stalled >= running/2 {
+		t.Errorf("Expected the stall clock to restart at the last touch, got %v after running %v", stalled, running)
+	}
+}
+
+func TestConsumer_PreservesOrderPerKey(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{Prefetch: 64, Workers: 8}, func(ctx context.Context, p testPayload) error {
+		mu.Lock()
+		seen[p.Token] = append(seen[p.Token], p.Seq)
+		mu.Unlock()
+		return nil
+	})
+	pool := c.startWorkers(context.Background())
+
+	tokens := []string{"a:1", "a:2", "b:1", "c:7"}
+	for seq := 0; seq < 50; seq++ {
+		for _, token := range tokens {
+			body := fmt.Sprintf(`{"token":%q,"seq":%d}`, token, seq)
+			c.dispatch(pool, amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(body)})
+		}
+	}
+	pool.stop()
+
+	for _, token := range tokens {
+		if len(seen[token]) != 50 {
+			t.Fatalf("Expected 50 deliveries for %s, got %d", token, len(seen[token]))
+		}
+		for i, seq := range seen[token] {
+			if seq != i {
+				t.Errorf("Deliveries for %s processed out of order: %v", token, seen[token])
+				break
+			}
+		}
+	}
+}
+
+func TestWorkerFor_SameKeySameWorker(t *testing.T) {
+	first := workerFor(testPayload{Token: "abc:1"}, amqp.Delivery{DeliveryTag: 1}, 8)
+	for tag := uint64(2); tag < 20; tag++ {
+		if got := workerFor(testPayload{Token: "abc:1"}, amqp.Delivery{DeliveryTag: tag}, 8); got != first {
+			t.Errorf("Expected key to map to worker %d, got %d", first, got)
+		}
+	}
+}
+
+func TestBatchConsumer_AcksEachDeliveryOnItsOwnOutcome(t *testing.T) {
+	var batches [][]testPayload
+	c := NewBatchConsumer(nil, "test_queue", config.QueueConfig{Prefetch: 10, Workers: 1, BatchSize: 3, BatchWindow: time.Second},
+		func(ctx context.Context, payloads []testPayload) []error {
+			batches = append(batches, payloads)
+			return make([]error, len(payloads))
+		})
+	pool := c.startWorkers(context.Background())
+
+	acks := make([]*fakeAcknowledger, 3)
+	for i := range acks {
+		acks[i] = &fakeAcknowledger{}
+		body := fmt.Sprintf(`{"token":"abc","seq":%d}`, i)
+		c.dispatch(pool, amqp.Delivery{Acknowledger: acks[i], Body: []byte(body)})
+	}
+	pool.stop()
+
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("Expected a single batch of 3 payloads, got %v", batches)
+	}
+	for i, ack := range acks {
+		if !ack.acked {
+			t.Errorf("Expected delivery %d to be acked", i)
+		}
+	}
+}
+
+func TestBatchConsumer_FlushesAfterWindow(t *testing.T) {
+	flushed := make(chan int, 1)
+	c := NewBatchConsumer(nil, "test_queue", config.QueueConfig{Prefetch: 10, Workers: 1, BatchSize: 100, BatchWindow: 10 * time.Millisecond},
+		func(ctx context.Context, payloads []testPayload) []error {
+			flushed <- len(payloads)
+			return make([]error, len(payloads))
+		})
+	pool := c.startWorkers(context.Background())
+	defer pool.stop()
+
+	c.dispatch(pool, amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(`{"token":"abc"}`)})
+
+	select {
+	case n := <-flushed:
+		if n != 1 {
+			t.Errorf("Expected partial batch of 1, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Batch was not flushed after the batch window")
+	}
+}
+
+func TestConsumerHandle_LogsWithDeliveryFields(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{}, func(ctx context.Context, p testPayload) error {
+		logging.FromContext(ctx).Info("handling")
+		return nil
+	})
+	pool := c.startWorkers(context.Background())
+	c.dispatch(pool, amqp.Delivery{
+		Acknowledger: &fakeAcknowledger{},
+		DeliveryTag:  7,
+		Headers:      amqp.Table{RetryCountHeader: int32(2)},
+		Body:         []byte(`{"token":"abc"}`),
+	})
+	pool.stop()
+
+	for _, raw := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var line map[string]any
+		if err := json.Unmarshal(raw, &line); err != nil {
+			t.Fatalf("failed to decode log line %q: %v", raw, err)
+		}
+		if line["msg"] != "handling" {
+			continue
+		}
+		if line["queue"] != "test_queue" || line["delivery_tag"] != float64(7) || line["retry_count"] != float64(2) {
+			t.Errorf("handler log line missing delivery fields: %v", line)
+		}
+		if line["token"] != "abc" {
+			t.Errorf("handler log line missing payload fields: %v", line)
+		}
+		return
+	}
+	t.Errorf("handler log line not found in %q", buf.String())
+}
+
+func TestConsumerHandle_ContinuesTraceFromHeaders(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	defaultProvider := otel.GetTracerProvider()
+	defaultPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(defaultProvider)
+	defer otel.SetTextMapPropagator(defaultPropagator)
+
+	var handlerSpan trace.SpanContext
+	c := NewConsumer(nil, "test_queue", config.QueueConfig{}, func(ctx context.Context, p testPayload) error {
+		handlerSpan = trace.SpanContextFromContext(ctx)
+		return nil
+	})
+	pool := c.startWorkers(context.Background())
+	c.dispatch(pool, amqp.Delivery{
+		Acknowledger: &fakeAcknowledger{},
+		Headers:      amqp.Table{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		Body:         []byte(`{"token":"abc"}`),
+	})
+	pool.stop()
+
+	if got := handlerSpan.TraceID().String(); got != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("Expected handler to run in the publisher's trace, got trace %s", got)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected process and handle spans, got %d", len(spans))
+	}
+	handle, process := spans[0], spans[1]
+	if process.Name() != "test_queue process" || process.Parent().SpanID().String() != "b7ad6b7169203331" {
+		t.Errorf("Expected process span under the remote parent, got %s under %s", process.Name(), process.Parent().SpanID())
+	}
+	if handle.Name() != "test_queue handle" || handle.Parent().SpanID() != process.SpanContext().SpanID() {
+		t.Errorf("Expected handle span under the process span, got %s under %s", handle.Name(), handle.Parent().SpanID())
+	}
+}
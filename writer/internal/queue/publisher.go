@@ -0,0 +1,185 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/chat/writer/internal/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Publisher publishes JSON payloads to queues on a channel in confirm mode.
+// Publish only returns nil once the broker has confirmed the message, so a
+// successful publish survives a broker restart. The trace context of the
+// publish span travels in the message headers.
+type Publisher struct {
+	rabbit *RabbitMQ
+
+	mu       sync.Mutex
+	ch       *amqp.Channel
+	declared map[string]bool
+	returns  chan amqp.Return
+
+	// mandatoryMu allows one mandatory publish in flight at a time
+	mandatoryMu sync.Mutex
+}
+
+// ErrUnroutable is returned by PublishMandatory when the broker returned the
+// message because no queue was bound to receive it.
+var ErrUnroutable = errors.New("message unroutable")
+
+func NewPublisher(rabbit *RabbitMQ) *Publisher {
+	return &Publisher{
+		rabbit: rabbit,
+	}
+}
+
+func (p *Publisher) Publish(ctx context.Context, queueName string, payload any) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, queueName+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationPublish,
+			semconv.MessagingDestinationName(queueName),
+		))
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	headers := amqp.Table{}
+	injectTrace(ctx, headers)
+
+	return p.PublishRaw(ctx, queueName, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  "application/json",
+		Headers:      headers,
+		Body:         body,
+	})
+}
+
+// PublishRaw publishes msg as-is and waits for the broker's confirm.
+func (p *Publisher) PublishRaw(ctx context.Context, queueName string, msg amqp.Publishing) error {
+	confirm, err := p.publish(ctx, queueName, msg)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("broker did not confirm publish to %s", queueName)
+	}
+	return nil
+}
+
+// PublishMandatory publishes msg to exchange with the mandatory flag and waits
+// for the broker's confirm. Unlike PublishRaw it doesn't declare anything, so
+// it returns ErrUnroutable if the broker returned msg instead of routing it.
+//
+// The broker sends a return before the confirm of the same message, and only
+// mandatory publishes can be returned. Serializing them therefore means a
+// return found once the confirm arrived belongs to msg.
+func (p *Publisher) PublishMandatory(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	p.mandatoryMu.Lock()
+	defer p.mandatoryMu.Unlock()
+
+	p.mu.Lock()
+	ch, err := p.channel()
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	returns := p.returns
+	// Left over from a publish whose confirm was never waited for
+	select {
+	case <-returns:
+	default:
+	}
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange,
+		routingKey,
+		true,  // mandatory
+		false, // immediate
+		msg,
+	)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	// returns is closed together with the channel
+	select {
+	case ret, ok := <-returns:
+		if ok {
+			return fmt.Errorf("%w: %s (exchange %q, routing key %q)", ErrUnroutable, ret.ReplyText, exchange, routingKey)
+		}
+	default:
+	}
+	if !acked {
+		return fmt.Errorf("broker did not confirm publish to %q", routingKey)
+	}
+	return nil
+}
+
+// publish sends msg under the lock; waiting for the confirm happens outside
+// it so concurrent publishers can pipeline.
+func (p *Publisher) publish(ctx context.Context, queueName string, msg amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, err := p.channel()
+	if err != nil {
+		return nil, err
+	}
+
+	// Publishing to a queue that doesn't exist yet would silently drop the message
+	if !p.declared[queueName] {
+		if _, err := p.rabbit.DeclareQueueWithDLQ(ch, queueName); err != nil {
+			return nil, fmt.Errorf("failed to declare queue with DLQ: %w", err)
+		}
+		p.declared[queueName] = true
+	}
+
+	return ch.PublishWithDeferredConfirmWithContext(ctx,
+		"",        // exchange
+		queueName, // routing key
+		false,     // mandatory
+		false,     // immediate
+		msg,
+	)
+}
+
+// channel returns the confirm-mode channel, reopening it after it was closed.
+func (p *Publisher) channel() (*amqp.Channel, error) {
+	if p.ch != nil && !p.ch.IsClosed() {
+		return p.ch, nil
+	}
+
+	ch, err := p.rabbit.CreateChannel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open publish channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	p.ch = ch
+	p.declared = make(map[string]bool)
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return ch, nil
+}
@@ -1,16 +1,40 @@
 package queue
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	InitialReconnectDelay = 1 * time.Second
+	MaxReconnectDelay     = 30 * time.Second
+)
+
+var ErrClosed = errors.New("rabbitmq connection closed")
+
 type RabbitMQ struct {
-	conn *amqp.Connection
+	url string
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	ready  chan struct{} // closed while conn is usable
+	closed bool
+	done   chan struct{}
+
+	// consumers holds every consumer whose RunConsumer loop is running and
+	// whether it is currently subscribed on an open channel
+	consumers map[string]bool
 }
 
+// ConsumerFunc declares the topology it needs on ch and processes deliveries
+// until the channel closes or ctx is cancelled.
+type ConsumerFunc func(ctx context.Context, ch *amqp.Channel) error
+
 func Connect(url string) (*RabbitMQ, error) {
 	var conn *amqp.Connection
 	var err error
@@ -19,10 +43,18 @@ func Connect(url string) (*RabbitMQ, error) {
 	for i := 0; i < 10; i++ {
 		conn, err = amqp.Dial(url)
 		if err == nil {
-			log.Println("Connected to RabbitMQ")
-			return &RabbitMQ{conn: conn}, nil
+			slog.Info("Connected to RabbitMQ")
+			r := &RabbitMQ{
+				url:       url,
+				ready:     make(chan struct{}),
+				done:      make(chan struct{}),
+				consumers: make(map[string]bool),
+			}
+			r.setConnection(conn)
+			go r.watch()
+			return r, nil
 		}
-		log.Printf("Failed to connect to RabbitMQ, retrying in 2s... (%d/10)", i+1)
+		slog.Warn("Failed to connect to RabbitMQ, retrying in 2s", "attempt", i+1, "max_attempts", 10, "error", err)
 		time.Sleep(2 * time.Second)
 	}
 
@@ -30,11 +62,193 @@ func Connect(url string) (*RabbitMQ, error) {
 }
 
 func (r *RabbitMQ) Close() error {
-	return r.conn.Close()
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	conn := r.conn
+	close(r.done)
+	r.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil
+	}
+	return conn.Close()
+}
+
+// IsConnected reports whether the connection is currently usable.
+func (r *RabbitMQ) IsConnected() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.closed && r.conn != nil && !r.conn.IsClosed()
+}
+
+// Consumers reports every consumer whose RunConsumer loop is still running
+// and whether it is currently subscribed.
+func (r *RabbitMQ) Consumers() map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	consumers := make(map[string]bool, len(r.consumers))
+	for name, subscribed := range r.consumers {
+		consumers[name] = subscribed
+	}
+	return consumers
+}
+
+func (r *RabbitMQ) setSubscribed(name string, subscribed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.consumers[name] = subscribed
+}
+
+func (r *RabbitMQ) removeConsumer(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.consumers, name)
 }
 
 func (r *RabbitMQ) CreateChannel() (*amqp.Channel, error) {
-	return r.conn.Channel()
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+
+	if conn == nil {
+		return nil, amqp.ErrClosed
+	}
+	return conn.Channel()
+}
+
+// RunConsumer keeps fn subscribed for the lifetime of ctx. Whenever the
+// channel or the underlying connection drops, it waits for the connection to
+// be re-established, opens a fresh channel and calls fn again so the consumer
+// redeclares its topology and resumes consuming.
+func (r *RabbitMQ) RunConsumer(ctx context.Context, name string, fn ConsumerFunc) {
+	delay := InitialReconnectDelay
+	r.setSubscribed(name, false)
+	defer r.removeConsumer(name)
+
+	for {
+		if err := r.waitReady(ctx); err != nil {
+			return
+		}
+
+		ch, err := r.CreateChannel()
+		if err != nil {
+			slog.Error("Failed to open channel", "queue", name, "error", err)
+		} else {
+			started := time.Now()
+			r.setSubscribed(name, true)
+			err = fn(ctx, ch)
+			r.setSubscribed(name, false)
+			if !ch.IsClosed() {
+				ch.Close()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Error("Consumer stopped", "queue", name, "error", err)
+			} else {
+				slog.Warn("Channel closed", "queue", name)
+			}
+			// A consumer that ran for a while earned a fast resubscribe
+			if time.Since(started) > MaxReconnectDelay {
+				delay = InitialReconnectDelay
+			}
+		}
+
+		slog.Info("Resubscribing", "queue", name, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.done:
+			return
+		case <-time.After(delay):
+		}
+		delay = nextReconnectDelay(delay)
+	}
+}
+
+func (r *RabbitMQ) setConnection(conn *amqp.Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conn = conn
+	close(r.ready)
+}
+
+// waitReady blocks until a usable connection is available.
+func (r *RabbitMQ) waitReady(ctx context.Context) error {
+	r.mu.Lock()
+	ready := r.ready
+	r.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-r.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watch listens for connection loss and reconnects with exponential backoff.
+func (r *RabbitMQ) watch() {
+	for {
+		r.mu.Lock()
+		conn := r.conn
+		r.mu.Unlock()
+
+		closeErr, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		r.ready = make(chan struct{})
+		r.mu.Unlock()
+
+		if ok && closeErr != nil {
+			slog.Error("RabbitMQ connection lost", "error", closeErr)
+		} else {
+			slog.Warn("RabbitMQ connection closed")
+		}
+
+		conn, err := r.reconnect()
+		if err != nil {
+			return
+		}
+		r.setConnection(conn)
+	}
+}
+
+func (r *RabbitMQ) reconnect() (*amqp.Connection, error) {
+	delay := InitialReconnectDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-r.done:
+			return nil, ErrClosed
+		case <-time.After(delay):
+		}
+
+		conn, err := amqp.Dial(r.url)
+		if err == nil {
+			slog.Info("Reconnected to RabbitMQ", "attempts", attempt)
+			return conn, nil
+		}
+		slog.Warn("Failed to reconnect to RabbitMQ", "attempt", attempt, "retry_in", delay, "error", err)
+		delay = nextReconnectDelay(delay)
+	}
+}
+
+func nextReconnectDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > MaxReconnectDelay {
+		delay = MaxReconnectDelay
+	}
+	return delay
 }
 
 func (r *RabbitMQ) DeclareQueue(ch *amqp.Channel, queueName string) (amqp.Queue, error) {
@@ -48,9 +262,15 @@ func (r *RabbitMQ) DeclareQueue(ch *amqp.Channel, queueName string) (amqp.Queue,
 	)
 }
 
+// deadLetterExchange is the exchange queueName's rejected messages are routed
+// through to its DLQ.
+func deadLetterExchange(queueName string) string {
+	return queueName + ".dlx"
+}
+
 // DeclareQueueWithDLQ declares a queue with dead letter exchange configured
 func (r *RabbitMQ) DeclareQueueWithDLQ(ch *amqp.Channel, queueName string) (amqp.Queue, error) {
-	dlxName := queueName + ".dlx"
+	dlxName := deadLetterExchange(queueName)
 	dlqName := queueName + ".dlq"
 
 	// Declare dead letter exchange
@@ -105,17 +325,17 @@ func (r *RabbitMQ) DeclareQueueWithDLQ(ch *amqp.Channel, queueName string) (amqp
 	)
 }
 
-func (r *RabbitMQ) Consume(ch *amqp.Channel, queueName string) (<-chan amqp.Delivery, error) {
+func (r *RabbitMQ) Consume(ch *amqp.Channel, queueName string, prefetch int) (<-chan amqp.Delivery, error) {
 	// Set QoS to prefetch multiple messages for better throughput
 	err := ch.Qos(
-		100,   // Prefetch 100 messages
-		0,     // No size limit
-		false, // Apply per channel
+		prefetch, // Unacked deliveries shared by the consumer's workers
+		0,        // No size limit
+		false,    // Apply per channel
 	)
 	if err != nil {
 		return nil, err
 	}
-	
+
 	return ch.Consume(
 		queueName, // queue
 		"",        // consumer
@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestNextReconnectDelay(t *testing.T) {
+	tests := []struct {
+		current  time.Duration
+		expected time.Duration
+	}{
+		{InitialReconnectDelay, 2 * time.Second},
+		{4 * time.Second, 8 * time.Second},
+		{20 * time.Second, MaxReconnectDelay},
+		{MaxReconnectDelay, MaxReconnectDelay},
+	}
+
+	for _, tt := range tests {
+		got := nextReconnectDelay(tt.current)
+		if got != tt.expected {
+			t.Errorf("nextReconnectDelay(%v) = %v, want %v", tt.current, got, tt.expected)
+		}
+	}
+}
+
+func TestRunConsumer_TracksConsumerUntilItStops(t *testing.T) {
+	// Never ready, so the consumer waits without subscribing
+	r := &RabbitMQ{
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+		consumers: make(map[string]bool),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		r.RunConsumer(ctx, "create_chats", func(ctx context.Context, ch *amqp.Channel) error {
+			return nil
+		})
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if subscribed, ok := r.Consumers()["create_chats"]; ok {
+			if subscribed {
+				t.Error("expected consumer waiting for a connection to be unsubscribed")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("consumer was never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	<-stopped
+	if _, ok := r.Consumers()["create_chats"]; ok {
+		t.Error("expected stopped consumer to be removed")
+	}
+}
@@ -1,29 +1,74 @@
 package queue
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand"
 	"time"
 
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/failure"
+	"github.com/chat/writer/internal/logging"
+	"github.com/chat/writer/internal/metrics"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 const (
-	MaxRetries           = 5
-	InitialRetryDelay    = 1 * time.Second
-	MaxRetryDelay        = 5 * time.Minute
-	RetryCountHeader     = "x-retry-count"
-	OriginalQueueHeader  = "x-original-queue"
-	FirstFailureHeader   = "x-first-failure-time"
+	RetryCountHeader    = "x-retry-count"
+	OriginalQueueHeader = "x-original-queue"
+	FirstFailureHeader  = "x-first-failure-time"
+	// FailureClassHeader and FailureReasonHeader record how the last failure
+	// was classified, e.g. "permanent" and "message_not_found"
+	FailureClassHeader  = "x-failure-class"
+	FailureReasonHeader = "x-failure-reason"
+	// LastErrorHeader holds the last failure's error message
+	LastErrorHeader = "x-last-error"
+	maxLastErrorLen = 1024
 )
 
+// RetryTiers are the delays retries are scheduled with. Each queue gets a
+// <queue>.retry.<N>ms delay queue per tier up to its policy's MaxDelay,
+// declared when its consumer starts, instead of one queue per distinct delay.
+var RetryTiers = []time.Duration{
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute, time.Hour,
+}
+
+// RetryPublisher republishes failed deliveries to delay queues and dead
+// letter exchanges. It is implemented by Publisher.
+type RetryPublisher interface {
+	PublishMandatory(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error
+}
+
+// RetryHandler applies a queue's RetryPolicy to its failed deliveries. A
+// failed delivery is only acked once the broker confirmed its republish.
 type RetryHandler struct {
-	maxRetries int
+	policy    config.RetryPolicy
+	publisher RetryPublisher
+	// tiers are the RetryTiers this policy's delays are quantized to
+	tiers []time.Duration
+	// random returns a number in [0, 1); replaced in tests
+	random func() float64
 }
 
-func NewRetryHandler() *RetryHandler {
+func NewRetryHandler(policy config.RetryPolicy, publisher RetryPublisher) *RetryHandler {
+	if policy.MaxDelay < policy.BaseDelay {
+		policy.MaxDelay = policy.BaseDelay
+	}
+
+	var tiers []time.Duration
+	for _, tier := range RetryTiers {
+		if tier <= policy.MaxDelay || len(tiers) == 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+
 	return &RetryHandler{
-		maxRetries: MaxRetries,
+		policy:    policy,
+		publisher: publisher,
+		tiers:     tiers,
+		random:    rand.Float64,
 	}
 }
 
@@ -32,51 +77,137 @@ func (rh *RetryHandler) GetRetryCount(msg amqp.Delivery) int {
 	if msg.Headers == nil {
 		return 0
 	}
-	
+
 	if count, ok := msg.Headers[RetryCountHeader].(int32); ok {
 		return int(count)
 	}
-	
+
 	return 0
 }
 
-// CalculateBackoff calculates exponential backoff delay
-func (rh *RetryHandler) CalculateBackoff(retryCount int) time.Duration {
-	// Exponential backoff: 1s, 2s, 4s, 8s, 16s, ... up to MaxRetryDelay
-	delay := InitialRetryDelay * time.Duration(1<<uint(retryCount))
-	
-	if delay > MaxRetryDelay {
-		delay = MaxRetryDelay
+// CalculateBackoff returns the exponential backoff before retry retryCount+1
+// of a failure of the given kind, before jitter: BaseDelay (ThrottledDelay
+// for throttled failures) doubled retryCount times, capped at MaxDelay.
+func (rh *RetryHandler) CalculateBackoff(kind failure.Kind, retryCount int) time.Duration {
+	delay := rh.policy.BaseDelay
+	if kind == failure.Throttled {
+		delay = rh.policy.ThrottledDelay
+	}
+
+	for i := 0; i < retryCount && delay < rh.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rh.policy.MaxDelay {
+		delay = rh.policy.MaxDelay
 	}
-	
+
 	return delay
 }
 
+// RetryDelay returns the delay before retry retryCount+1: the backoff with
+// jitter applied, quantized to one of the handler's tiers.
+func (rh *RetryHandler) RetryDelay(kind failure.Kind, retryCount int) time.Duration {
+	return rh.quantize(rh.jitter(rh.CalculateBackoff(kind, retryCount)))
+}
+
+func (rh *RetryHandler) jitter(delay time.Duration) time.Duration {
+	switch rh.policy.Jitter {
+	case "none":
+		return delay
+	case "full":
+		return time.Duration(rh.random() * float64(delay))
+	default: // "equal"
+		return delay/2 + time.Duration(rh.random()*float64(delay/2))
+	}
+}
+
+// quantize rounds delay to one of the two tiers around it, picking the upper
+// one with a probability proportional to how close delay is to it. Rounding
+// that way keeps the average delay and the spread jitter created, where
+// always rounding to the nearest tier would bunch retries up again.
+func (rh *RetryHandler) quantize(delay time.Duration) time.Duration {
+	if delay <= rh.tiers[0] {
+		return rh.tiers[0]
+	}
+	for i := 1; i < len(rh.tiers); i++ {
+		lower, upper := rh.tiers[i-1], rh.tiers[i]
+		if delay > upper {
+			continue
+		}
+		if rh.random() < float64(delay-lower)/float64(upper-lower) {
+			return upper
+		}
+		return lower
+	}
+	return rh.tiers[len(rh.tiers)-1]
+}
+
 // ShouldRetry determines if a message should be retried
 func (rh *RetryHandler) ShouldRetry(msg amqp.Delivery) bool {
 	retryCount := rh.GetRetryCount(msg)
-	return retryCount < rh.maxRetries
+	return retryCount < rh.policy.MaxAttempts
+}
+
+// expired reports whether a retry after delay would land more than the
+// policy's MaxAge after the message first failed.
+func (rh *RetryHandler) expired(msg amqp.Delivery, delay time.Duration) bool {
+	if rh.policy.MaxAge <= 0 {
+		return false
+	}
+	firstFailure := time.Unix(rh.getFirstFailureTime(msg), 0)
+	return time.Since(firstFailure)+delay > rh.policy.MaxAge
 }
 
-// PrepareRetry prepares a message for retry with updated headers
-func (rh *RetryHandler) PrepareRetry(msg amqp.Delivery, originalQueue string) amqp.Publishing {
+// DeclareRetryTiers declares the delay queue of every tier for queueName.
+// Expired messages are dead-lettered back to queueName through the default
+// exchange.
+func (rh *RetryHandler) DeclareRetryTiers(ch *amqp.Channel, queueName string) error {
+	for _, tier := range rh.tiers {
+		_, err := ch.QueueDeclare(
+			retryQueueName(queueName, tier),
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			amqp.Table{
+				"x-message-ttl":             int32(tier.Milliseconds()),
+				"x-dead-letter-exchange":    "", // default exchange
+				"x-dead-letter-routing-key": queueName,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare retry queue for %s: %w", tier, err)
+		}
+	}
+	return nil
+}
+
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queueName, delay.Milliseconds())
+}
+
+// PrepareRetry prepares a message for retry with updated headers. The trace
+// context of ctx replaces the delivery's, so the retried delivery continues
+// the trace as a child of the failed attempt.
+func (rh *RetryHandler) PrepareRetry(ctx context.Context, msg amqp.Delivery, originalQueue string) amqp.Publishing {
 	retryCount := rh.GetRetryCount(msg) + 1
-	
+
 	headers := make(amqp.Table)
 	if msg.Headers != nil {
 		for k, v := range msg.Headers {
 			headers[k] = v
 		}
 	}
-	
+
 	headers[RetryCountHeader] = int32(retryCount)
 	headers[OriginalQueueHeader] = originalQueue
-	
+
 	// Set first failure time if not already set
 	if _, ok := headers[FirstFailureHeader]; !ok {
 		headers[FirstFailureHeader] = time.Now().Unix()
 	}
-	
+	injectTrace(ctx, headers)
+
 	return amqp.Publishing{
 		DeliveryMode: amqp.Persistent,
 		ContentType:  msg.ContentType,
@@ -85,68 +216,107 @@ func (rh *RetryHandler) PrepareRetry(msg amqp.Delivery, originalQueue string) am
 	}
 }
 
-// HandleFailedMessage handles a failed message with retry logic
-func (rh *RetryHandler) HandleFailedMessage(ch *amqp.Channel, msg amqp.Delivery, queueName string, err error) error {
+// HandleFailedMessage routes a failed message by the classification of err:
+// permanent failures go straight to the DLQ, transient ones are retried with
+// exponential backoff and throttled ones with a longer backoff, until the
+// policy's MaxAttempts or MaxAge is reached. If the republish to the delay
+// queue isn't confirmed, the delivery is requeued on its own queue instead. It
+// logs through the logger carried by ctx.
+func (rh *RetryHandler) HandleFailedMessage(ctx context.Context, msg amqp.Delivery, queueName string, err error) error {
+	kind, reason := failure.Classify(err)
+	logger := logging.FromContext(ctx).With("failure_class", kind.String(), "failure_reason", reason)
+	ctx = logging.NewContext(ctx, logger)
 	retryCount := rh.GetRetryCount(msg)
-	
-	log.Printf("Message processing failed (retry %d/%d): %v", retryCount, rh.maxRetries, err)
-	
-	if rh.ShouldRetry(msg) {
-		// Calculate backoff delay
-		delay := rh.CalculateBackoff(retryCount)
-		log.Printf("Retrying message after %v (attempt %d/%d)", delay, retryCount+1, rh.maxRetries)
-		
-		// Nack with requeue to retry queue with delay
-		return rh.requeueWithDelay(ch, msg, queueName, delay)
-	}
-	
-	// Max retries exceeded, send to DLQ
-	log.Printf("Max retries exceeded, sending to DLQ")
-	firstFailure := rh.getFirstFailureTime(msg)
-	log.Printf("Message first failed at %v, total time in retry: %v", 
-		time.Unix(firstFailure, 0), 
-		time.Since(time.Unix(firstFailure, 0)))
-	
-	// Nack without requeue - will go to DLQ via dead letter exchange
-	return msg.Nack(false, false)
-}
-
-// requeueWithDelay requeues a message with a delay using TTL
-func (rh *RetryHandler) requeueWithDelay(ch *amqp.Channel, msg amqp.Delivery, originalQueue string, delay time.Duration) error {
-	// Create delay queue with TTL
-	delayQueueName := fmt.Sprintf("%s.retry.%dms", originalQueue, delay.Milliseconds())
-	
-	_, err := ch.QueueDeclare(
-		delayQueueName,
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		amqp.Table{
-			"x-message-ttl":            int32(delay.Milliseconds()),
-			"x-dead-letter-exchange":   "", // default exchange
-			"x-dead-letter-routing-key": originalQueue,
-		},
-	)
+
+	logger.Warn("Message processing failed", "retry", retryCount, "max_retries", rh.policy.MaxAttempts, "error", err)
+
+	if kind == failure.Permanent {
+		logger.Error("Permanent failure, sending to DLQ")
+		metrics.DeadLetteredTotal.WithLabelValues(queueName, metrics.ReasonPermanent).Inc()
+		return rh.deadLetter(ctx, msg, queueName, err)
+	}
+
+	if !rh.ShouldRetry(msg) {
+		firstFailure := rh.getFirstFailureTime(msg)
+		logger.Error("Max retries exceeded, sending to DLQ",
+			"first_failure", time.Unix(firstFailure, 0),
+			"time_in_retry", time.Since(time.Unix(firstFailure, 0)))
+		metrics.DeadLetteredTotal.WithLabelValues(queueName, metrics.ReasonMaxRetries).Inc()
+		return rh.deadLetter(ctx, msg, queueName, err)
+	}
+
+	delay := rh.RetryDelay(kind, retryCount)
+	if rh.expired(msg, delay) {
+		logger.Error("Retry would exceed max age, sending to DLQ",
+			"first_failure", time.Unix(rh.getFirstFailureTime(msg), 0),
+			"delay", delay, "max_age", rh.policy.MaxAge)
+		metrics.DeadLetteredTotal.WithLabelValues(queueName, metrics.ReasonMaxAge).Inc()
+		return rh.deadLetter(ctx, msg, queueName, err)
+	}
+
+	logger.Info("Retrying message", "delay", delay, "attempt", retryCount+1, "max_retries", rh.policy.MaxAttempts)
+	if err := rh.requeueWithDelay(ctx, msg, queueName, delay, err); err != nil {
+		// Redelivered right away with the same retry count, but not lost
+		logger.Warn("Retry publish not confirmed, requeueing", "error", err)
+		metrics.RetryRequeuesTotal.WithLabelValues(queueName).Inc()
+		return msg.Nack(false, true)
+	}
+	metrics.RetriesTotal.WithLabelValues(queueName).Inc()
+	return nil
+}
+
+// SetFailureHeaders records the classification and message of err in headers.
+func SetFailureHeaders(headers amqp.Table, err error) {
+	kind, reason := failure.Classify(err)
+	headers[FailureClassHeader] = kind.String()
+	headers[FailureReasonHeader] = reason
+
+	message := err.Error()
+	if len(message) > maxLastErrorLen {
+		message = message[:maxLastErrorLen]
+	}
+	headers[LastErrorHeader] = message
+}
+
+// deadLetter publishes msg to its queue's dead letter exchange with the
+// failure headers set and acks it once the broker confirmed. Rejecting the
+// delivery would dead-letter it too, but without a way to add headers; that
+// is the fallback if the publish fails.
+func (rh *RetryHandler) deadLetter(ctx context.Context, msg amqp.Delivery, queueName string, cause error) error {
+	headers := make(amqp.Table, len(msg.Headers)+3)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	SetFailureHeaders(headers, cause)
+
+	err := rh.publisher.PublishMandatory(ctx, deadLetterExchange(queueName), "", amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  msg.ContentType,
+		Body:         msg.Body,
+		Headers:      headers,
+	})
 	if err != nil {
-		return err
+		logging.FromContext(ctx).Warn("Failed to publish to DLQ, rejecting instead", "error", err)
+		return msg.Nack(false, false)
 	}
-	
+
+	return msg.Ack(false)
+}
+
+// requeueWithDelay publishes msg to the delay queue of the tier delay, which
+// dead-letters it back to originalQueue once it expires. msg is acked once the
+// broker confirmed the publish; on error it is left unacknowledged.
+func (rh *RetryHandler) requeueWithDelay(ctx context.Context, msg amqp.Delivery, originalQueue string, delay time.Duration, cause error) error {
 	// Prepare message with updated retry count
-	publishing := rh.PrepareRetry(msg, originalQueue)
-	
+	publishing := rh.PrepareRetry(ctx, msg, originalQueue)
+	SetFailureHeaders(publishing.Headers, cause)
+
 	// Publish to delay queue
-	err = ch.Publish(
-		"",             // exchange
-		delayQueueName, // routing key
-		false,          // mandatory
-		false,          // immediate
-		publishing,
-	)
+	err := rh.publisher.PublishMandatory(ctx, "", retryQueueName(originalQueue, delay), publishing)
 	if err != nil {
 		return err
 	}
-	
+
 	// Ack original message
 	return msg.Ack(false)
 }
@@ -156,22 +326,21 @@ func (rh *RetryHandler) getFirstFailureTime(msg amqp.Delivery) int64 {
 	if msg.Headers == nil {
 		return time.Now().Unix()
 	}
-	
+
 	if timestamp, ok := msg.Headers[FirstFailureHeader].(int64); ok {
 		return timestamp
 	}
-	
+
 	return time.Now().Unix()
 }
 
 // LogRetryMetrics logs retry metrics for monitoring
-func (rh *RetryHandler) LogRetryMetrics(msg amqp.Delivery) {
+func (rh *RetryHandler) LogRetryMetrics(logger *slog.Logger, msg amqp.Delivery) {
 	retryCount := rh.GetRetryCount(msg)
 	if retryCount > 0 {
 		firstFailure := rh.getFirstFailureTime(msg)
 		timeSinceFirstFailure := time.Since(time.Unix(firstFailure, 0))
-		
-		log.Printf("Retry metrics - Count: %d, Time since first failure: %v", 
-			retryCount, timeSinceFirstFailure)
+
+		logger.Info("Redelivered after retry", "time_since_first_failure", timeSinceFirstFailure)
 	}
 }
@@ -1,14 +1,33 @@
 package queue
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/failure"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var testPolicy = config.RetryPolicy{
+	MaxAttempts:    5,
+	BaseDelay:      time.Second,
+	ThrottledDelay: 30 * time.Second,
+	MaxDelay:       5 * time.Minute,
+	Jitter:         "none",
+	MaxAge:         time.Hour,
+}
+
 func TestGetRetryCount(t *testing.T) {
-	rh := NewRetryHandler()
+	rh := NewRetryHandler(testPolicy, nil)
 
 	tests := []struct {
 		name     string
@@ -49,36 +68,163 @@ func TestGetRetryCount(t *testing.T) {
 }
 
 func TestCalculateBackoff(t *testing.T) {
-	rh := NewRetryHandler()
+	rh := NewRetryHandler(testPolicy, nil)
 
 	tests := []struct {
-		retryCount   int
-		expectedMin  time.Duration
-		expectedMax  time.Duration
-		description  string
+		kind        failure.Kind
+		retryCount  int
+		expected    time.Duration
+		description string
 	}{
-		{0, 1 * time.Second, 1 * time.Second, "First retry: 1s"},
-		{1, 2 * time.Second, 2 * time.Second, "Second retry: 2s"},
-		{2, 4 * time.Second, 4 * time.Second, "Third retry: 4s"},
-		{3, 8 * time.Second, 8 * time.Second, "Fourth retry: 8s"},
-		{4, 16 * time.Second, 16 * time.Second, "Fifth retry: 16s"},
-		{5, 32 * time.Second, 32 * time.Second, "Sixth retry: 32s"},
-		{10, MaxRetryDelay, MaxRetryDelay, "Large retry: capped at max"},
+		{failure.Transient, 0, 1 * time.Second, "First retry: 1s"},
+		{failure.Transient, 1, 2 * time.Second, "Second retry: 2s"},
+		{failure.Transient, 2, 4 * time.Second, "Third retry: 4s"},
+		{failure.Transient, 3, 8 * time.Second, "Fourth retry: 8s"},
+		{failure.Transient, 4, 16 * time.Second, "Fifth retry: 16s"},
+		{failure.Transient, 5, 32 * time.Second, "Sixth retry: 32s"},
+		{failure.Transient, 10, testPolicy.MaxDelay, "Large retry: capped at max"},
+		{failure.Transient, 100, testPolicy.MaxDelay, "Huge retry: no overflow"},
+		{failure.Throttled, 0, 30 * time.Second, "Throttled first retry: 30s"},
+		{failure.Throttled, 3, 4 * time.Minute, "Throttled fourth retry: 4m"},
+		{failure.Throttled, 4, testPolicy.MaxDelay, "Throttled fifth retry: capped at max"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.description, func(t *testing.T) {
-			got := rh.CalculateBackoff(tt.retryCount)
-			if got < tt.expectedMin || got > tt.expectedMax {
-				t.Errorf("CalculateBackoff(%d) = %v, want between %v and %v",
-					tt.retryCount, got, tt.expectedMin, tt.expectedMax)
+			if got := rh.CalculateBackoff(tt.kind, tt.retryCount); got != tt.expected {
+				t.Errorf("CalculateBackoff(%s, %d) = %v, want %v", tt.kind, tt.retryCount, got, tt.expected)
 			}
 		})
 	}
 }
 
+func TestNewRetryHandler_TiersUpToMaxDelay(t *testing.T) {
+	rh := NewRetryHandler(config.RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}, nil)
+	expected := []time.Duration{time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second}
+	if fmt.Sprint(rh.tiers) != fmt.Sprint(expected) {
+		t.Errorf("tiers = %v, want %v", rh.tiers, expected)
+	}
+
+	rh = NewRetryHandler(config.RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 100 * time.Millisecond}, nil)
+	if len(rh.tiers) != 1 || rh.tiers[0] != time.Second {
+		t.Errorf("expected the smallest tier when MaxDelay is below it, got %v", rh.tiers)
+	}
+}
+
+func TestRetryDelay_Jitter(t *testing.T) {
+	tests := []struct {
+		jitter   string
+		random   float64
+		expected time.Duration
+	}{
+		// 8s backoff before the fourth retry. The same random number picks
+		// the jitter and then the upper of the two tiers around the delay if
+		// it is below the delay's position between them.
+		{"none", 0.5, 10 * time.Second}, // 8s: 0.6 of the way from 5s to 10s
+		{"none", 0.99, 5 * time.Second},
+		{"full", 0, time.Second},          // 0s
+		{"full", 0.99, 5 * time.Second},   // 7.92s
+		{"equal", 0, 5 * time.Second},     // 4s: 0.67 of the way from 2s to 5s
+		{"equal", 0.99, 5 * time.Second},  // 7.96s
+		{"unknown", 0.9, 5 * time.Second}, // equal: 7.6s
+		{"unknown", 0.1, 5 * time.Second}, // equal: 4.4s, 0.8 of the way from 2s to 5s
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.jitter, tt.random), func(t *testing.T) {
+			policy := testPolicy
+			policy.Jitter = tt.jitter
+			rh := NewRetryHandler(policy, nil)
+			rh.random = func() float64 { return tt.random }
+
+			if got := rh.RetryDelay(failure.Transient, 3); got != tt.expected {
+				t.Errorf("RetryDelay() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetryDelay_AlwaysATierAndSpread(t *testing.T) {
+	policy := testPolicy
+	policy.Jitter = "full"
+	rh := NewRetryHandler(policy, nil)
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		delay := rh.RetryDelay(failure.Transient, 4)
+		if !slices.Contains(rh.tiers, delay) {
+			t.Fatalf("RetryDelay() = %v is not a tier", delay)
+		}
+		seen[delay] = true
+	}
+	if len(seen) < 3 {
+		t.Errorf("expected jittered delays to spread over several tiers, got %v", seen)
+	}
+}
+
+func TestQuantize_KeepsAverageDelay(t *testing.T) {
+	rh := NewRetryHandler(testPolicy, nil)
+
+	// 8s sits 3/5 of the way from the 5s to the 10s tier
+	var total time.Duration
+	const n = 10000
+	for i := 0; i < n; i++ {
+		total += rh.quantize(8 * time.Second)
+	}
+	if avg := total / n; avg < 7500*time.Millisecond || avg > 8500*time.Millisecond {
+		t.Errorf("average quantized delay %v, want about 8s", avg)
+	}
+
+	if got := rh.quantize(time.Hour); got != testPolicy.MaxDelay {
+		t.Errorf("quantize(1h) = %v, want the largest tier %v", got, testPolicy.MaxDelay)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	rh := NewRetryHandler(testPolicy, nil)
+
+	fresh := amqp.Delivery{Headers: amqp.Table{FirstFailureHeader: time.Now().Add(-time.Minute).Unix()}}
+	old := amqp.Delivery{Headers: amqp.Table{FirstFailureHeader: time.Now().Add(-59 * time.Minute).Unix()}}
+
+	if rh.expired(fresh, 5*time.Minute) {
+		t.Error("expected a recent failure not to be expired")
+	}
+	if !rh.expired(old, 5*time.Minute) {
+		t.Error("expected a retry past MaxAge to be expired")
+	}
+	if rh.expired(amqp.Delivery{}, 5*time.Minute) {
+		t.Error("expected a first failure not to be expired")
+	}
+
+	policy := testPolicy
+	policy.MaxAge = 0
+	if NewRetryHandler(policy, nil).expired(old, time.Hour) {
+		t.Error("expected no MaxAge to never expire")
+	}
+}
+
+func TestSetFailureHeaders(t *testing.T) {
+	headers := amqp.Table{}
+	SetFailureHeaders(headers, fmt.Errorf("update: %w", failure.NewPermanent("message_not_found", errors.New("message not found"))))
+
+	if headers[FailureClassHeader] != "permanent" || headers[FailureReasonHeader] != "message_not_found" {
+		t.Errorf("unexpected classification headers %v", headers)
+	}
+	if headers[LastErrorHeader] != "update: message not found" {
+		t.Errorf("unexpected last error %v", headers[LastErrorHeader])
+	}
+
+	SetFailureHeaders(headers, errors.New(strings.Repeat("x", 5000)))
+	if headers[FailureClassHeader] != "transient" || headers[FailureReasonHeader] != "unclassified" {
+		t.Errorf("expected unknown errors to be transient, got %v", headers)
+	}
+	if len(headers[LastErrorHeader].(string)) != maxLastErrorLen {
+		t.Errorf("expected the last error to be truncated to %d bytes", maxLastErrorLen)
+	}
+}
+
 func TestShouldRetry(t *testing.T) {
-	rh := NewRetryHandler()
+	rh := NewRetryHandler(testPolicy, nil)
 
 	tests := []struct {
 		name        string
@@ -106,7 +252,7 @@ func TestShouldRetry(t *testing.T) {
 }
 
 func TestPrepareRetry(t *testing.T) {
-	rh := NewRetryHandler()
+	rh := NewRetryHandler(testPolicy, nil)
 
 	msg := amqp.Delivery{
 		ContentType: "application/json",
@@ -117,7 +263,7 @@ func TestPrepareRetry(t *testing.T) {
 		},
 	}
 
-	publishing := rh.PrepareRetry(msg, "test_queue")
+	publishing := rh.PrepareRetry(context.Background(), msg, "test_queue")
 
 	// Check retry count incremented
 	retryCount, ok := publishing.Headers[RetryCountHeader].(int32)
@@ -154,7 +300,7 @@ func TestPrepareRetry(t *testing.T) {
 }
 
 func TestPrepareRetry_PreservesFirstFailureTime(t *testing.T) {
-	rh := NewRetryHandler()
+	rh := NewRetryHandler(testPolicy, nil)
 
 	firstFailureTime := time.Now().Add(-1 * time.Hour).Unix()
 
@@ -166,7 +312,7 @@ func TestPrepareRetry_PreservesFirstFailureTime(t *testing.T) {
 		},
 	}
 
-	publishing := rh.PrepareRetry(msg, "test_queue")
+	publishing := rh.PrepareRetry(context.Background(), msg, "test_queue")
 
 	// Check first failure time preserved
 	preservedTime, ok := publishing.Headers[FirstFailureHeader].(int64)
@@ -175,25 +321,53 @@ func TestPrepareRetry_PreservesFirstFailureTime(t *testing.T) {
 	}
 }
 
+func TestPrepareRetry_CarriesTraceContext(t *testing.T) {
+	defaultPropagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(defaultPropagator)
+
+	rh := NewRetryHandler(testPolicy, nil)
+	msg := amqp.Delivery{
+		Body: []byte(`{"test":"data"}`),
+		Headers: amqp.Table{
+			"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		},
+	}
+
+	failedAttempt := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x0a, 0xf7, 0x65, 0x19, 0x16, 0xcd, 0x43, 0xdd, 0x84, 0x48, 0xeb, 0x21, 0x1c, 0x80, 0x31, 0x9c},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), failedAttempt)
+
+	publishing := rh.PrepareRetry(ctx, msg, "test_queue")
+
+	expected := "00-0af7651916cd43dd8448eb211c80319c-00f067aa0ba902b7-01"
+	if got := publishing.Headers["traceparent"]; got != expected {
+		t.Errorf("Expected traceparent %q of the failed attempt, got %v", expected, got)
+	}
+}
+
 func TestExponentialBackoffProgression(t *testing.T) {
-	rh := NewRetryHandler()
+	rh := NewRetryHandler(testPolicy, nil)
 
 	var previousDelay time.Duration
 	for i := 0; i < 5; i++ {
-		delay := rh.CalculateBackoff(i)
-		
+		delay := rh.CalculateBackoff(failure.Transient, i)
+
 		// Each delay should be double the previous (exponential)
 		if i > 0 && delay <= previousDelay {
 			t.Errorf("Backoff not exponential: retry %d has delay %v, previous was %v",
 				i, delay, previousDelay)
 		}
-		
+
 		previousDelay = delay
 	}
 }
 
 func TestRetryCountIncrement(t *testing.T) {
-	rh := NewRetryHandler()
+	rh := NewRetryHandler(testPolicy, nil)
 
 	// Start with no retries
 	msg := amqp.Delivery{
@@ -203,8 +377,8 @@ func TestRetryCountIncrement(t *testing.T) {
 
 	// Simulate multiple retries
 	for expectedCount := int32(1); expectedCount <= 5; expectedCount++ {
-		publishing := rh.PrepareRetry(msg, "test_queue")
-		
+		publishing := rh.PrepareRetry(context.Background(), msg, "test_queue")
+
 		actualCount, ok := publishing.Headers[RetryCountHeader].(int32)
 		if !ok || actualCount != expectedCount {
 			t.Errorf("Retry %d: expected count %d, got %v", expectedCount, expectedCount, actualCount)
@@ -222,3 +396,78 @@ func TestRetryCountIncrement(t *testing.T) {
 		t.Error("Should not retry after 5 attempts")
 	}
 }
+
+type published struct {
+	exchange   string
+	routingKey string
+	msg        amqp.Publishing
+}
+
+type fakeRetryPublisher struct {
+	published []published
+	err       error
+}
+
+func (f *fakeRetryPublisher) PublishMandatory(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.published = append(f.published, published{exchange, routingKey, msg})
+	return nil
+}
+
+func TestHandleFailedMessage(t *testing.T) {
+	unroutable := fmt.Errorf("%w: NO_ROUTE", ErrUnroutable)
+
+	tests := []struct {
+		name       string
+		retryCount int32
+		err        error
+		publishErr error
+		exchange   string
+		routingKey string
+		acked      bool
+		requeued   bool
+	}{
+		{"transient goes to the first tier", 0, errors.New("boom"), nil, "", "test_queue.retry.1000ms", true, false},
+		{"permanent goes to the DLX", 0, failure.NewPermanent("message_not_found", nil), nil, "test_queue.dlx", "", true, false},
+		{"out of retries goes to the DLX", 5, errors.New("boom"), nil, "test_queue.dlx", "", true, false},
+		{"unconfirmed retry is requeued", 0, errors.New("boom"), unroutable, "", "", false, true},
+		{"unconfirmed dead letter is rejected", 0, failure.NewPermanent("message_not_found", nil), unroutable, "", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &fakeRetryPublisher{err: tt.publishErr}
+			rh := NewRetryHandler(testPolicy, publisher)
+			ack := &fakeAcknowledger{}
+			msg := amqp.Delivery{
+				Acknowledger: ack,
+				Body:         []byte(`{"test":"data"}`),
+				Headers:      amqp.Table{RetryCountHeader: tt.retryCount, FirstFailureHeader: time.Now().Unix()},
+			}
+
+			if err := rh.HandleFailedMessage(context.Background(), msg, "test_queue", tt.err); err != nil {
+				t.Fatalf("HandleFailedMessage() = %v", err)
+			}
+
+			if ack.acked != tt.acked || ack.nacked == tt.acked || ack.requeue != tt.requeued {
+				t.Errorf("expected acked=%v requeued=%v, got acked=%v nacked=%v requeue=%v",
+					tt.acked, tt.requeued, ack.acked, ack.nacked, ack.requeue)
+			}
+			if tt.publishErr != nil {
+				return
+			}
+			if len(publisher.published) != 1 {
+				t.Fatalf("expected one publish, got %d", len(publisher.published))
+			}
+			p := publisher.published[0]
+			if p.exchange != tt.exchange || p.routingKey != tt.routingKey {
+				t.Errorf("published to %q/%q, want %q/%q", p.exchange, p.routingKey, tt.exchange, tt.routingKey)
+			}
+			if _, ok := p.msg.Headers[FailureClassHeader]; !ok {
+				t.Error("expected failure headers on the republished message")
+			}
+		})
+	}
+}
@@ -4,17 +4,85 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/chat/writer/internal/breaker"
+	"github.com/chat/writer/internal/config"
 	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/failure"
+	"github.com/chat/writer/internal/logging"
+	"github.com/chat/writer/internal/metrics"
+	"github.com/chat/writer/internal/tracing"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const messagesIndex = "messages"
+
+var ErrIndexerClosed = errors.New("elasticsearch bulk indexer closed")
+
 type ElasticsearchService struct {
-	client *database.ElasticsearchClient
-	ctx    context.Context
+	client  *database.ElasticsearchClient
+	ctx     context.Context
+	cfg     config.ElasticsearchConfig
+	indexer esutil.BulkIndexer
+	// breaker fails requests fast while Elasticsearch is unavailable
+	breaker *breaker.Breaker
+
+	mu     sync.RWMutex // guards closed against concurrent Add
+	closed bool
+	stats  indexStats
+}
+
+// IndexStats counts per-item outcomes of the bulk pipeline.
+type IndexStats struct {
+	Succeeded uint64
+	Retried   uint64
+	Failed    uint64
+}
+
+type indexStats struct {
+	succeeded atomic.Uint64
+	retried   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// responseError is a failed delete-by-query response.
+type responseError struct {
+	Status int
+	Body   string
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("error deleting documents by query: %s", e.Body)
+}
+
+// ItemError is the per-item error reported by the _bulk API.
+type ItemError struct {
+	DocumentID string
+	Status     int
+	Type       string
+	Reason     string
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("bulk item %s failed with status %d: %s: %s", e.DocumentID, e.Status, e.Type, e.Reason)
+}
+
+// Retryable reports whether the item may succeed if sent again.
+func (e *ItemError) Retryable() bool {
+	return e.Status == 429 || e.Status >= 500
 }
 
 type MessageDocument struct {
@@ -25,23 +93,73 @@ type MessageDocument struct {
 	Body       string `json:"body"`
 	SenderID   int    `json:"sender_id"`
 	SenderName string `json:"sender_name,omitempty"`
+	Edited     bool   `json:"edited"`
+	EditCount  int    `json:"edit_count"`
 	CreatedAt  string `json:"created_at"`
+
+	// Version is messages.version. It is sent as the external document
+	// version rather than stored in the source.
+	Version int64 `json:"-"`
 }
 
-func NewElasticsearchService(client *database.ElasticsearchClient, ctx context.Context) *ElasticsearchService {
+func NewElasticsearchService(client *database.ElasticsearchClient, ctx context.Context, cfg config.ElasticsearchConfig) (*ElasticsearchService, error) {
+	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        client.Client,
+		Index:         messagesIndex,
+		NumWorkers:    cfg.Workers,
+		FlushBytes:    cfg.FlushBytes,
+		FlushInterval: cfg.FlushInterval,
+		Refresh:       cfg.Refresh,
+		OnError: func(ctx context.Context, err error) {
+			slog.Error("Elasticsearch bulk indexer error", "error", err)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bulk indexer: %w", err)
+	}
+
 	es := &ElasticsearchService{
-		client: client,
-		ctx:    ctx,
+		client:  client,
+		ctx:     ctx,
+		cfg:     cfg,
+		indexer: indexer,
+		breaker: breaker.New("elasticsearch", cfg.Breaker, client.PingContext, isUnavailable),
 	}
 
 	// Create index if it doesn't exist
 	es.createIndexIfNotExists()
 
-	return es
+	return es, nil
+}
+
+// Breaker returns the circuit breaker guarding requests to Elasticsearch.
+func (es *ElasticsearchService) Breaker() *breaker.Breaker {
+	return es.breaker
+}
+
+// Close flushes pending items and stops the bulk indexer.
+func (es *ElasticsearchService) Close(ctx context.Context) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.closed {
+		return nil
+	}
+	es.closed = true
+
+	return es.indexer.Close(ctx)
+}
+
+func (es *ElasticsearchService) Stats() IndexStats {
+	return IndexStats{
+		Succeeded: es.stats.succeeded.Load(),
+		Retried:   es.stats.retried.Load(),
+		Failed:    es.stats.failed.Load(),
+	}
 }
 
 func (es *ElasticsearchService) createIndexIfNotExists() {
-	indexName := "messages"
+	indexName := messagesIndex
 
 	// Check if index exists
 	req := esapi.IndicesExistsRequest{
@@ -50,7 +168,7 @@ func (es *ElasticsearchService) createIndexIfNotExists() {
 
 	res, err := req.Do(es.ctx, es.client)
 	if err != nil {
-		log.Printf("Error checking if index exists: %v", err)
+		slog.Error("Error checking if index exists", "index", messagesIndex, "error", err)
 		return
 	}
 	defer res.Body.Close()
@@ -102,6 +220,8 @@ func (es *ElasticsearchService) createIndexIfNotExists() {
 				},
 				"sender_id": { "type": "integer" },
 				"sender_name": { "type": "keyword" },
+				"edited": { "type": "boolean" },
+				"edit_count": { "type": "integer" },
 				"created_at": { "type": "date" }
 			}
 		}
@@ -114,79 +234,286 @@ func (es *ElasticsearchService) createIndexIfNotExists() {
 
 	createRes, err := createReq.Do(es.ctx, es.client)
 	if err != nil {
-		log.Printf("Error creating index: %v", err)
+		slog.Error("Error creating index", "index", messagesIndex, "error", err)
 		return
 	}
 	defer createRes.Body.Close()
 
 	if createRes.IsError() {
-		log.Printf("Error creating index: %s", createRes.String())
+		slog.Error("Error creating index", "index", messagesIndex, "response", createRes.String())
 	} else {
-		log.Println("Created Elasticsearch index: messages")
+		slog.Info("Created Elasticsearch index", "index", messagesIndex)
 	}
 }
 
-func (es *ElasticsearchService) IndexMessage(doc MessageDocument) error {
+// IndexMessage writes doc with external versioning, so Elasticsearch only
+// accepts it if doc.Version is newer than the indexed one. A version conflict
+// means the index already holds this or a newer version and counts as
+// success; it is logged with both versions, since an index ahead of MySQL
+// would otherwise go unnoticed.
+func (es *ElasticsearchService) IndexMessage(ctx context.Context, doc MessageDocument) error {
 	// Create document ID from token:chat_number:message_number
-	docID := fmt.Sprintf("%s:%d:%d", doc.Token, doc.ChatNumber, doc.Number)
+	docID := documentID(doc.Token, doc.ChatNumber, doc.Number)
 
 	data, err := json.Marshal(doc)
 	if err != nil {
 		return err
 	}
 
-	req := esapi.IndexRequest{
-		Index:      "messages",
-		DocumentID: docID,
-		Body:       bytes.NewReader(data),
-		Refresh:    "true",
+	version := doc.Version
+	return es.submit(ctx, esutil.BulkIndexerItem{
+		Action:      "index",
+		DocumentID:  docID,
+		Version:     &version,
+		VersionType: "external",
+	}, data)
+}
+
+// DeleteMessage removes a message document. A document that is already gone
+// counts as deleted.
+func (es *ElasticsearchService) DeleteMessage(ctx context.Context, token string, chatNumber int, messageNumber int) error {
+	return es.submit(ctx, esutil.BulkIndexerItem{
+		Action:     "delete",
+		DocumentID: documentID(token, chatNumber, messageNumber),
+	}, nil)
+}
+
+// DeleteChatMessages removes every document of a chat with delete-by-query.
+func (es *ElasticsearchService) DeleteChatMessages(ctx context.Context, token string, chatNumber int) error {
+	return es.deleteByQuery(ctx,
+		map[string]any{"term": map[string]any{"token": token}},
+		map[string]any{"term": map[string]any{"chat_number": chatNumber}},
+	)
+}
+
+// DeleteApplicationMessages removes every document of an application with delete-by-query.
+func (es *ElasticsearchService) DeleteApplicationMessages(ctx context.Context, token string) error {
+	return es.deleteByQuery(ctx,
+		map[string]any{"term": map[string]any{"token": token}},
+	)
+}
+
+func (es *ElasticsearchService) deleteByQuery(ctx context.Context, filters ...map[string]any) (err error) {
+	ctx, span := startSpan(ctx, "delete_by_query")
+	defer func() { tracing.End(span, err) }()
+
+	return es.breaker.Do(func() error {
+		return es.doDeleteByQuery(ctx, filters)
+	})
+}
+
+func (es *ElasticsearchService) doDeleteByQuery(ctx context.Context, filters []map[string]any) error {
+	query := map[string]any{
+		"query": map[string]any{
+			"bool": map[string]any{
+				"filter": filters,
+			},
+		},
 	}
 
-	res, err := req.Do(es.ctx, es.client)
+	data, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+
+	refresh := es.cfg.Refresh == "true"
+	req := esapi.DeleteByQueryRequest{
+		Index:     []string{messagesIndex},
+		Body:      bytes.NewReader(data),
+		Conflicts: "proceed",
+		Refresh:   &refresh,
+	}
+
+	res, err := req.Do(ctx, es.client)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return fmt.Errorf("error indexing document: %s", res.String())
+		err := &responseError{Status: res.StatusCode, Body: res.String()}
+		if res.StatusCode == 429 {
+			return failure.NewThrottled("elasticsearch_rejected", err)
+		}
+		return err
 	}
 
 	return nil
 }
 
-func (es *ElasticsearchService) UpdateMessage(token string, chatNumber int, messageNumber int, body string) error {
-	// Create document ID
-	docID := fmt.Sprintf("%s:%d:%d", token, chatNumber, messageNumber)
+func documentID(token string, chatNumber int, messageNumber int) string {
+	return fmt.Sprintf("%s:%d:%d", token, chatNumber, messageNumber)
+}
 
-	// Update only the body field
-	updateDoc := map[string]any{
-		"doc": map[string]interface{}{
-			"body": body,
-		},
+// submit queues item on the bulk indexer and waits for its own outcome.
+// Retryable failures (429/5xx or a failed flush) are re-queued with backoff up
+// to MaxRetries times; anything else is recorded as failed and returned.
+func (es *ElasticsearchService) submit(ctx context.Context, item esutil.BulkIndexerItem, body []byte) (err error) {
+	ctx, span := startSpan(ctx, item.Action, attribute.String("elasticsearch.document_id", item.DocumentID))
+	defer func() { tracing.End(span, err) }()
+
+	return es.breaker.Do(func() error {
+		return es.submitWithRetries(ctx, item, body)
+	})
+}
+
+func (es *ElasticsearchService) submitWithRetries(ctx context.Context, item esutil.BulkIndexerItem, body []byte) (err error) {
+	span := trace.SpanFromContext(ctx)
+	delay := 100 * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		span.SetAttributes(attribute.Int("elasticsearch.attempts", attempt+1))
+		err = es.add(ctx, item, body)
+		if err == nil {
+			es.stats.succeeded.Add(1)
+			metrics.ElasticsearchItemsTotal.WithLabelValues(item.Action, "succeeded").Inc()
+			return nil
+		}
+
+		if !isRetryable(err) || attempt >= es.cfg.MaxRetries {
+			es.stats.failed.Add(1)
+			metrics.ElasticsearchItemsTotal.WithLabelValues(item.Action, "failed").Inc()
+			logging.FromContext(ctx).Error("Elasticsearch item failed", "action", item.Action, "document_id", item.DocumentID, "attempts", attempt+1, "error", err)
+			return classify(err)
+		}
+
+		es.stats.retried.Add(1)
+		metrics.ElasticsearchItemsTotal.WithLabelValues(item.Action, "retried").Inc()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
 	}
+}
 
-	data, err := json.Marshal(updateDoc)
+func (es *ElasticsearchService) add(ctx context.Context, item esutil.BulkIndexerItem, body []byte) error {
+	result := make(chan error, 1)
+	// The callbacks get the indexer's context, not the caller's logger
+	callerCtx := ctx
+
+	if body != nil {
+		item.Body = bytes.NewReader(body)
+	}
+	item.OnSuccess = func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
+		result <- nil
+	}
+	item.OnFailure = func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+		if err != nil {
+			// The whole flush failed (e.g. connection refused)
+			result <- fmt.Errorf("bulk request failed: %w", err)
+			return
+		}
+		if item.Action == "delete" && res.Status == 404 {
+			result <- nil
+			return
+		}
+		if item.VersionType == "external" && res.Status == 409 {
+			// Already indexed at this version or a newer one. Logged anyway: a
+			// document indexed ahead of messages.version never gets corrected
+			metrics.ElasticsearchItemsTotal.WithLabelValues(item.Action, "conflict").Inc()
+			logging.FromContext(callerCtx).Warn("Elasticsearch document already at this or a newer version",
+				"document_id", item.DocumentID, "version", *item.Version,
+				"indexed_version", indexedVersion(res.Error.Reason), "reason", res.Error.Reason)
+			result <- nil
+			return
+		}
+		result <- &ItemError{
+			DocumentID: item.DocumentID,
+			Status:     res.Status,
+			Type:       res.Error.Type,
+			Reason:     res.Error.Reason,
+		}
+	}
+
+	es.mu.RLock()
+	if es.closed {
+		es.mu.RUnlock()
+		return ErrIndexerClosed
+	}
+	err := es.indexer.Add(ctx, item)
+	es.mu.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	req := esapi.UpdateRequest{
-		Index:      "messages",
-		DocumentID: docID,
-		Body:       bytes.NewReader(data),
-		Refresh:    "true",
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	res, err := req.Do(es.ctx, es.client)
+var currentVersionPattern = regexp.MustCompile(`current version \[(\d+)\]`)
+
+// indexedVersion extracts the version Elasticsearch holds from a version
+// conflict reason, or returns -1 if the reason doesn't say.
+func indexedVersion(reason string) int64 {
+	m := currentVersionPattern.FindStringSubmatch(reason)
+	if m == nil {
+		return -1
+	}
+	v, err := strconv.ParseInt(m[1], 10, 64)
 	if err != nil {
+		return -1
+	}
+	return v
+}
+
+// startSpan starts a client span for an operation on the messages index.
+// Bulk items are flushed by the indexer's own workers, so the span covers
+// waiting for the item's outcome rather than a single HTTP request.
+func startSpan(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		semconv.DBSystemElasticsearch,
+		semconv.DBOperation(operation),
+		attribute.String("elasticsearch.index", messagesIndex),
+	)
+	return tracing.Tracer().Start(ctx, "elasticsearch "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+}
+
+// classify marks item errors for the retry handler: 429 means Elasticsearch is
+// shedding load, any other 4xx fails the same way however often it is sent.
+func classify(err error) error {
+	var itemErr *ItemError
+	if !errors.As(err, &itemErr) {
 		return err
 	}
-	defer res.Body.Close()
+	switch {
+	case itemErr.Status == 429:
+		return failure.NewThrottled("elasticsearch_rejected", err)
+	case itemErr.Status >= 400 && itemErr.Status < 500:
+		reason := itemErr.Type
+		if reason == "" {
+			reason = fmt.Sprintf("elasticsearch_%d", itemErr.Status)
+		}
+		return failure.NewPermanent(reason, err)
+	}
+	return err
+}
 
-	if res.IsError() {
-		return fmt.Errorf("error updating document: %s", res.String())
+// isUnavailable reports whether err means Elasticsearch couldn't be reached
+// or failed on its side, as opposed to rejecting the request.
+func isUnavailable(err error) bool {
+	var itemErr *ItemError
+	if errors.As(err, &itemErr) {
+		return itemErr.Status >= 500
+	}
+	var resErr *responseError
+	if errors.As(err, &resErr) {
+		return resErr.Status >= 500
 	}
+	return !errors.Is(err, ErrIndexerClosed) && !errors.Is(err, context.Canceled)
+}
 
-	return nil
+func isRetryable(err error) bool {
+	var itemErr *ItemError
+	if errors.As(err, &itemErr) {
+		return itemErr.Retryable()
+	}
+	return !errors.Is(err, ErrIndexerClosed) && !errors.Is(err, context.Canceled)
 }
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chat/writer/internal/breaker"
+	"github.com/chat/writer/internal/config"
+	"github.com/chat/writer/internal/database"
+	"github.com/chat/writer/internal/failure"
+	"github.com/chat/writer/internal/logging"
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// newTestService starts a fake Elasticsearch whose _bulk endpoint answers each
+// item with the status returned by statusFor.
+func newTestService(t *testing.T, statusFor func(docID string, attempt int) int) *ElasticsearchService {
+	return newTestServiceWithMeta(t, func(docID string, attempt int, meta map[string]any) int {
+		return statusFor(docID, attempt)
+	})
+}
+
+// newTestServiceWithMeta is like newTestService, but statusFor also sees the
+// bulk action metadata of each item.
+func newTestServiceWithMeta(t *testing.T, statusFor func(docID string, attempt int, meta map[string]any) int) *ElasticsearchService {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			w.Write([]byte(`{}`))
+			return
+		}
+
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var meta map[string]map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+				continue
+			}
+			for action, fields := range meta {
+				id, ok := fields["_id"].(string)
+				if !ok {
+					continue
+				}
+				mu.Lock()
+				attempts[id]++
+				status := statusFor(id, attempts[id], fields)
+				mu.Unlock()
+
+				item := fmt.Sprintf(`{"%s":{"_id":%q,"status":%d}}`, action, id, status)
+				if status >= 300 {
+					item = fmt.Sprintf(`{"%s":{"_id":%q,"status":%d,"error":{"type":"test_error","reason":"status %d"}}}`, action, id, status, status)
+				}
+				items = append(items, item)
+				scanner.Scan() // skip the document body
+			}
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	es, err := NewElasticsearchService(&database.ElasticsearchClient{Client: client}, context.Background(), config.ElasticsearchConfig{
+		FlushBytes:    1 << 20,
+		FlushInterval: 10 * time.Millisecond,
+		Workers:       1,
+		Refresh:       "false",
+		MaxRetries:    2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	t.Cleanup(func() { es.Close(context.Background()) })
+
+	return es
+}
+
+func TestIndexMessage_RetriesThrottledItems(t *testing.T) {
+	es := newTestService(t, func(docID string, attempt int) int {
+		if attempt == 1 {
+			return 429
+		}
+		return 201
+	})
+
+	err := es.IndexMessage(context.Background(), MessageDocument{Token: "abc", ChatNumber: 1, Number: 1, Body: "hello"})
+	if err != nil {
+		t.Fatalf("Expected retry to succeed, got: %v", err)
+	}
+
+	stats := es.Stats()
+	if stats.Succeeded != 1 || stats.Retried != 1 || stats.Failed != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestIndexMessage_ReportsPerItemErrors(t *testing.T) {
+	es := newTestService(t, func(docID string, attempt int) int {
+		if docID == "abc:1:2" {
+			return 400
+		}
+		return 201
+	})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = es.IndexMessage(context.Background(), MessageDocument{Token: "abc", ChatNumber: 1, Number: i + 1})
+		}(i)
+	}
+	wg.Wait()
+
+	var itemErr *ItemError
+	if !errors.As(errs[1], &itemErr) || itemErr.Status != 400 {
+		t.Errorf("Expected a 400 item error for abc:1:2, got: %v", errs[1])
+	}
+	if kind, _ := failure.Classify(errs[1]); kind != failure.Permanent {
+		t.Errorf("Expected a 400 item error to be permanent, got %s", kind)
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("Expected other items to succeed, got: %v, %v", errs[0], errs[2])
+	}
+
+	stats := es.Stats()
+	if stats.Failed != 1 || stats.Retried != 0 {
+		t.Errorf("Expected a single non-retried failure, got: %+v", stats)
+	}
+}
+
+func TestIndexMessage_GivesUpAfterMaxRetries(t *testing.T) {
+	es := newTestService(t, func(docID string, attempt int) int {
+		return 503
+	})
+
+	err := es.IndexMessage(context.Background(), MessageDocument{Token: "abc", ChatNumber: 1, Number: 1})
+
+	var itemErr *ItemError
+	if !errors.As(err, &itemErr) || itemErr.Status != 503 {
+		t.Fatalf("Expected a 503 item error, got: %v", err)
+	}
+	if stats := es.Stats(); stats.Retried != 2 || stats.Failed != 1 {
+		t.Errorf("Expected 2 retries then a failure, got: %+v", stats)
+	}
+	if kind, _ := failure.Classify(err); kind != failure.Transient {
+		t.Errorf("Expected a 503 item error to be transient, got %s", kind)
+	}
+}
+
+func TestIndexMessage_FailsFastWhileBreakerOpen(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	es := newTestService(t, func(docID string, attempt int) int {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		return 503
+	})
+	es.breaker = breaker.New("test", config.BreakerConfig{FailureThreshold: 1, Cooldown: time.Hour}, es.client.PingContext, isUnavailable)
+
+	if err := es.IndexMessage(context.Background(), MessageDocument{Token: "abc", ChatNumber: 1, Number: 1}); errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("Expected the first failure to reach Elasticsearch, got: %v", err)
+	}
+	mu.Lock()
+	sent := requests
+	mu.Unlock()
+
+	err := es.IndexMessage(context.Background(), MessageDocument{Token: "abc", ChatNumber: 1, Number: 2})
+	if !errors.Is(err, breaker.ErrOpen) {
+		t.Errorf("Expected ErrOpen once the breaker opened, got: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != sent {
+		t.Errorf("Expected no request while the breaker is open, got %d more", requests-sent)
+	}
+}
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&ItemError{Status: 503}, true},
+		{&ItemError{Status: 400}, false},
+		{&ItemError{Status: 429}, false},
+		{&responseError{Status: 500}, true},
+		{&responseError{Status: 404}, false},
+		{fmt.Errorf("bulk request failed: %w", errors.New("connection refused")), true},
+		{ErrIndexerClosed, false},
+	}
+
+	for _, tt := range tests {
+		if got := isUnavailable(tt.err); got != tt.expected {
+			t.Errorf("isUnavailable(%v) = %v, want %v", tt.err, got, tt.expected)
+		}
+	}
+}
+
+func TestIndexMessage_ThrottledAfterMaxRetries(t *testing.T) {
+	es := newTestService(t, func(docID string, attempt int) int {
+		return 429
+	})
+
+	err := es.IndexMessage(context.Background(), MessageDocument{Token: "abc", ChatNumber: 1, Number: 1})
+
+	if kind, reason := failure.Classify(err); kind != failure.Throttled || reason != "elasticsearch_rejected" {
+		t.Errorf("Expected a throttled failure, got %s %s: %v", kind, reason, err)
+	}
+}
+
+func TestIndexMessage_UsesExternalVersionAndIgnoresConflicts(t *testing.T) {
+	var mu sync.Mutex
+	var meta map[string]any
+	es := newTestServiceWithMeta(t, func(docID string, attempt int, fields map[string]any) int {
+		mu.Lock()
+		meta = fields
+		mu.Unlock()
+		return 409
+	})
+
+	var buf bytes.Buffer
+	ctx := logging.NewContext(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)))
+	err := es.IndexMessage(ctx, MessageDocument{Token: "abc", ChatNumber: 1, Number: 1, Version: 42})
+	if err != nil {
+		t.Fatalf("Expected a version conflict to count as success, got: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"level":"WARN"`) || !strings.Contains(buf.String(), `"document_id":"abc:1:1"`) {
+		t.Errorf("Expected the conflict to be logged as a warning, got: %s", buf.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if meta["version"] != float64(42) || meta["version_type"] != "external" {
+		t.Errorf("Expected external version 42, got: %v", meta)
+	}
+}
+
+func TestIndexedVersion(t *testing.T) {
+	reason := "[abc:1:1]: version conflict, current version [7] is higher or equal to the one provided [3]"
+	if got := indexedVersion(reason); got != 7 {
+		t.Errorf("Expected indexed version 7, got %d", got)
+	}
+	if got := indexedVersion("status 409"); got != -1 {
+		t.Errorf("Expected -1 for an unknown reason, got %d", got)
+	}
+}
@@ -0,0 +1,40 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/codes"
+)
+
+func TestRedisHook_SpanPerCommand(t *testing.T) {
+	recorder := recordSpans(t)
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	client.AddHook(RedisHook{})
+
+	ctx, parent := Tracer().Start(context.Background(), "handler")
+	client.Set(ctx, "chat_counter:abc", 3, 0)
+	if err := client.Get(ctx, "missing").Err(); err != redis.Nil {
+		t.Fatalf("expected redis.Nil, got %v", err)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	set, get := spans[0], spans[1]
+	if set.Name() != "redis set" || get.Name() != "redis get" {
+		t.Errorf("unexpected span names %q, %q", set.Name(), get.Name())
+	}
+	if set.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("expected command span under the caller's span")
+	}
+	if get.Status().Code == codes.Error {
+		t.Error("a missing key should not be recorded as an error")
+	}
+}
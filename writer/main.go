@@ -2,111 +2,247 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/chat/writer/internal/backpressure"
+	"github.com/chat/writer/internal/breaker"
 	"github.com/chat/writer/internal/config"
 	"github.com/chat/writer/internal/cron"
 	"github.com/chat/writer/internal/database"
 	"github.com/chat/writer/internal/handlers"
+	"github.com/chat/writer/internal/health"
+	"github.com/chat/writer/internal/logging"
+	"github.com/chat/writer/internal/metrics"
 	"github.com/chat/writer/internal/queue"
 	"github.com/chat/writer/internal/services"
+	"github.com/chat/writer/internal/tracing"
 )
 
 func main() {
-	log.Println("Starting Writer Service...")
-
 	// Load configuration
 	cfg := config.Load()
+
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		os.Exit(runDLQ(cfg, os.Args[2:]))
+	}
+
+	logging.Setup(cfg.Log)
+
+	slog.Info("Starting Writer Service...")
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Export spans; a no-op unless OTEL_TRACES_EXPORTER is set
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		fatal("Failed to set up tracing", err)
+	}
+
 	// Connect to MySQL
 	db, err := database.Connect(cfg.DatabaseHost, cfg.DatabaseUser, cfg.DatabasePassword, cfg.DatabaseName)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("Failed to connect to database", err)
 	}
 	defer db.Close()
+	db.Breaker = breaker.New("mysql", cfg.MySQLBreaker, db.PingContext, database.IsUnavailable)
 
 	// Connect to Redis
 	redisClient, err := database.ConnectRedis(cfg.RedisURL, ctx)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		fatal("Failed to connect to Redis", err)
 	}
 	defer redisClient.Close()
 
 	// Connect to RabbitMQ
 	rabbit, err := queue.Connect(cfg.RabbitMQURL)
 	if err != nil {
-		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+		fatal("Failed to connect to RabbitMQ", err)
 	}
 	defer rabbit.Close()
 
 	// Connect to Elasticsearch
 	esClient, err := database.ConnectElasticsearch(cfg.ElasticsearchURL)
 	if err != nil {
-		log.Printf("Warning: Failed to connect to Elasticsearch: %v", err)
-		log.Println("Continuing without Elasticsearch support")
+		slog.Warn("Failed to connect to Elasticsearch, continuing without Elasticsearch support", "error", err)
 	}
 
 	// Initialize Elasticsearch service
 	var esService *services.ElasticsearchService
 	if esClient != nil {
-		esService = services.NewElasticsearchService(esClient, ctx)
+		esService, err = services.NewElasticsearchService(esClient, ctx, cfg.Elasticsearch)
+		if err != nil {
+			slog.Warn("Failed to start Elasticsearch indexing", "error", err)
+			esService = nil
+		}
+	}
+
+	// Search indexing jobs are only published while Elasticsearch is enabled
+	publisher := queue.NewPublisher(rabbit)
+	var indexQueue handlers.Publisher
+	if esService != nil {
+		indexQueue = publisher
 	}
 
 	// Initialize handlers
-	chatHandler := handlers.NewChatHandler(db, redisClient)
-	messageHandler := handlers.NewMessageHandler(db, esService, redisClient)
+	chatHandler := handlers.NewChatHandler(db, esService, redisClient)
+	messageHandler := handlers.NewMessageHandler(db, indexQueue, redisClient)
+	applicationHandler := handlers.NewApplicationHandler(db, esService, redisClient)
+
+	// Every consumer pauses while MySQL is down; those that also write to
+	// Elasticsearch pause while it is
+	var esBreaker *breaker.Breaker
+	if esService != nil {
+		esBreaker = esService.Breaker()
+	}
+
+	// Every consumer shares one limit on deliveries handled at once, lowered
+	// while queries queue up for a pooled MySQL connection
+	limiter := backpressure.New(cfg.Backpressure, db.Stats)
 
 	// Initialize consumers
-	chatConsumer := queue.NewChatConsumer(rabbit, chatHandler)
-	messageConsumer := queue.NewMessageConsumer(rabbit, messageHandler)
+	consumers := []queue.Runner{
+		queue.NewConsumer(rabbit, "create_chats", cfg.Queue("create_chats"), chatHandler.CreateChat).
+			PauseWhileOpen(db.Breaker).LimitBy(limiter),
+		queue.NewBatchConsumer(rabbit, "create_messages", cfg.Queue("create_messages"), messageHandler.CreateMessages).
+			PauseWhileOpen(db.Breaker).LimitBy(limiter),
+		queue.NewConsumer(rabbit, "update_messages", cfg.Queue("update_messages"), messageHandler.UpdateMessage).
+			PauseWhileOpen(db.Breaker).LimitBy(limiter),
+		queue.NewConsumer(rabbit, "delete_messages", cfg.Queue("delete_messages"), messageHandler.DeleteMessage).
+			PauseWhileOpen(db.Breaker).LimitBy(limiter),
+		queue.NewConsumer(rabbit, "delete_chats", cfg.Queue("delete_chats"), chatHandler.DeleteChat).
+			PauseWhileOpen(db.Breaker, esBreaker).LimitBy(limiter),
+		queue.NewConsumer(rabbit, "delete_applications", cfg.Queue("delete_applications"), applicationHandler.DeleteApplication).
+			PauseWhileOpen(db.Breaker, esBreaker).LimitBy(limiter),
+	}
+	if esService != nil {
+		indexHandler := handlers.NewIndexHandler(db, esService, cfg.Elasticsearch.IndexConcurrency)
+		consumers = append(consumers,
+			queue.NewBatchConsumer(rabbit, handlers.IndexQueue, cfg.Queue(handlers.IndexQueue), indexHandler.SyncMessages).
+				PauseWhileOpen(db.Breaker, esBreaker).LimitBy(limiter))
+	}
+
+	// Initialize cron jobs; only the replica holding the lease runs them
+	countSync := cron.NewCountSync(db, redisClient, cfg.CountSync)
+	reconciler := cron.NewReconciler(db, redisClient, cfg.Reconcile)
 
-	// Initialize cron job
-	countSync := cron.NewCountSync(db, redisClient)
+	scheduler := cron.NewScheduler()
+	jobs := []cron.Job{
+		{
+			Name:       "count_sync",
+			Schedule:   cfg.CountSync.Schedule,
+			Jitter:     cfg.CountSync.Jitter,
+			RunOnStart: true,
+			RunOnStop:  true, // flush counts changed since the last run
+			Run:        countSync.Sync,
+		},
+		{
+			Name:       "count_reconcile",
+			Schedule:   cfg.Reconcile.Schedule,
+			Jitter:     cfg.Reconcile.Jitter,
+			RunOnStart: true,
+			Run:        reconciler.Reconcile,
+		},
+	}
+	for _, job := range jobs {
+		if err := scheduler.Add(job); err != nil {
+			fatal("Failed to schedule cron job", err)
+		}
+	}
+	cronLeader := cron.NewLeader(redisClient, "cron", cfg.Cron.LeaseTTL)
 
 	// WaitGroup to track all goroutines
 	var wg sync.WaitGroup
 
 	// Start consumers in separate goroutines
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		chatConsumer.Start(ctx)
-	}()
+	for _, consumer := range consumers {
+		wg.Add(1)
+		go func(consumer queue.Runner) {
+			defer wg.Done()
+			consumer.Start(ctx)
+		}(consumer)
+	}
 
+	// Adapt the consumers' limit to connection pool contention
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		messageConsumer.StartCreateConsumer(ctx)
+		limiter.Run(ctx)
 	}()
 
+	// Start cron jobs
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		messageConsumer.StartUpdateConsumer(ctx)
+		cronLeader.Run(ctx, scheduler.Start)
 	}()
 
-	// Start cron job
-	wg.Add(1)
+	// Liveness fails when a consumer loop died or stopped making progress;
+	// readiness also needs every dependency. Elasticsearch is optional, so it
+	// only degrades.
+	consumerNames := make([]string, len(consumers))
+	for i, consumer := range consumers {
+		consumerNames[i] = consumer.QueueName()
+	}
+	liveness := health.NewChecker()
+	liveness.Add("consumers", true, health.Consumers(consumerNames, false, rabbit.Consumers))
+	liveness.Add("consumer_progress", true, health.Stalled(cfg.StallTimeout, func() map[string]time.Duration {
+		stalls := make(map[string]time.Duration, len(consumers))
+		for _, consumer := range consumers {
+			stalls[consumer.QueueName()] = consumer.StalledFor()
+		}
+		return stalls
+	}))
+
+	readiness := health.NewChecker()
+	readiness.Add("mysql", true, db.PingContext)
+	readiness.Add("redis", true, func(ctx context.Context) error {
+		return redisClient.Ping(ctx).Err()
+	})
+	readiness.Add("rabbitmq", true, func(ctx context.Context) error {
+		if !rabbit.IsConnected() {
+			return errors.New("not connected")
+		}
+		return nil
+	})
+	readiness.Add("consumers", true, health.Consumers(consumerNames, true, rabbit.Consumers))
+	readiness.Add("mysql_breaker", true, db.Breaker.Check)
+	readiness.Add("elasticsearch", false, func(ctx context.Context) error {
+		if esService == nil {
+			return errors.New("indexing disabled")
+		}
+		return esClient.PingContext(ctx)
+	})
+	readiness.Add("elasticsearch_breaker", false, esBreaker.Check)
+
+	// Serve metrics and health checks
+	metrics.RegisterDB(db.DB)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", liveness.Handler())
+	mux.Handle("/readyz", readiness.Handler())
+	server := &http.Server{Addr: cfg.HTTPAddr, Handler: mux}
 	go func() {
-		defer wg.Done()
-		countSync.Start(ctx)
+		slog.Info("Serving metrics and health checks", "addr", cfg.HTTPAddr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server stopped", "error", err)
+		}
 	}()
 
-	log.Println("Writer Service started successfully")
+	slog.Info("Writer Service started successfully")
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
-	log.Println("Shutting down Writer Service...")
+	slog.Info("Shutting down Writer Service...")
 
 	// Cancel context to signal all goroutines to stop
 	cancel()
@@ -120,10 +256,38 @@ func main() {
 
 	select {
 	case <-done:
-		log.Println("All goroutines stopped gracefully")
+		slog.Info("All goroutines stopped gracefully")
 	case <-time.After(30 * time.Second):
-		log.Println("Shutdown timeout exceeded, forcing exit")
+		slog.Warn("Shutdown timeout exceeded, forcing exit")
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down HTTP server", "error", err)
+	}
+	shutdownCancel()
+
+	// Flush items still buffered in the bulk indexer
+	if esService != nil {
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := esService.Close(flushCtx); err != nil {
+			slog.Error("Error flushing Elasticsearch bulk indexer", "error", err)
+		}
+		flushCancel()
 	}
 
-	log.Println("Writer Service stopped")
+	// Export the spans still buffered
+	tracingCtx, tracingCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(tracingCtx); err != nil {
+		slog.Error("Error flushing trace exporter", "error", err)
+	}
+	tracingCancel()
+
+	slog.Info("Writer Service stopped")
+}
+
+// fatal logs msg with err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }